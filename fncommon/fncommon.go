@@ -1,6 +1,7 @@
 package fncommon
 
 import (
+	"errors"
 	"os"
 	"strconv"
 )
@@ -24,3 +25,14 @@ func GetEnvInt(key string, fallback int) int {
 	}
 	return fallback
 }
+
+func GetEnvIntOrError(key string, fallback int) (int, error) {
+	if value, ok := os.LookupEnv(key); ok {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, errors.New(key + " must be an integer: " + err.Error())
+		}
+		return i, nil
+	}
+	return fallback, nil
+}
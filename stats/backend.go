@@ -0,0 +1,154 @@
+package stats
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// The statistics APIs obtain the value of each statistic from a queryBackend, which by default is Prometheus (see prometheus_backend.go)
+// Handlers use statisticsBackend, so that an alternative store can be used without changing them
+
+// A source of statistics
+type queryBackend interface {
+	// QueryRange returns the values of a single statistic over a range of time
+	QueryRange(ctx context.Context, query *statisticQuery) (*rangeResult, error)
+	// QueryCurrent returns the value of a single statistic at a single time
+	QueryCurrent(ctx context.Context, query *statisticQuery) (*currentResult, error)
+	// QueryTop returns the routes with the highest values of a statistic, which may not be supported
+	QueryTop(ctx context.Context, query *topQuery) (*topResult, error)
+}
+
+// the source of all statistics returned by the statistics APIs
+var statisticsBackend queryBackend = &prometheusBackend{}
+
+// A query for a single statistic at global, application or route scope
+type statisticQuery struct {
+	statistic   Statistic
+	mode        string      // how a counter is returned: modeCumulative, modeRate or modeIncrease
+	quantile    *float64    // if not nil, return this quantile of the statistic, which must be a histogram, rather than its mean
+	scope       *queryScope // the application, route and Fn server, and any grouping, window and step
+	startTime   time.Time   // the start of the range, not used by QueryCurrent
+	endTime     time.Time   // the end of the range, or the time at which QueryCurrent evaluates the statistic
+	extraParams url.Values  // any additional parameters supported by the backend, such as those supported by Thanos
+}
+
+// The values of a statistic over a range of time
+type rangeResult struct {
+	values        []metricsTimeValuePair            // if the query was not grouped
+	groupedValues map[string][]metricsTimeValuePair // if the query was grouped, keyed by the value of the groupByLabel of its scope
+	source        string                            // optional, identifies where the values were obtained, such as the base URL of a Prometheus server
+	warnings      []string                          // any warnings, such as those returned by Thanos if the values may be incomplete
+}
+
+// The value of a statistic at a single time
+type currentResult struct {
+	value    *float64 // nil if there is no value at that time
+	source   string   // optional, identifies where the value was obtained, such as the base URL of a Prometheus server
+	warnings []string // any warnings, such as those returned by Thanos if the value may be incomplete
+}
+
+// A query for the routes with the highest values of a statistic, calculated over the window of its scope
+type topQuery struct {
+	by          string      // the statistic used to rank the routes: topByCalls, topByErrorRatio, topByTimeouts or topByDurations
+	quantile    float64     // if by is topByDurations, the quantile of the durations used to rank the routes, or 0 for the mean
+	n           int         // the maximum number of routes to return
+	scope       *queryScope // the application and Fn server, and the window over which the statistic is calculated
+	endTime     time.Time   // the end of the window
+	extraParams url.Values  // any additional parameters supported by the backend, such as those supported by Thanos
+}
+
+// The routes with the highest values of a statistic
+type topResult struct {
+	routes   []topRoute // ordered with the highest value first
+	source   string     // optional, identifies where the routes were obtained, such as the base URL of a Prometheus server
+	warnings []string   // any warnings, such as those returned by Thanos if the routes may be incomplete
+}
+
+// Return the queries for the statistics and quantiles requested by params, keyed by the name of the key that will hold
+// each of them in the returned JSON data structure
+// Quantiles are of the durations histogram
+func (params *queryParams) statisticQueries(scope *queryScope) map[string]*statisticQuery {
+
+	queries := make(map[string]*statisticQuery)
+	for _, statistic := range params.statistics {
+		queries[statistic.Key] = params.statisticQuery(statistic, nil, scope)
+	}
+	durations := builtinStatistics[durationsConst]
+	for _, quantile := range params.quantiles {
+		quantile := quantile
+		query := params.statisticQuery(durations, &quantile, scope)
+		queries[query.jsonKey()] = query
+	}
+	return queries
+}
+
+func (params *queryParams) statisticQuery(statistic Statistic, quantile *float64, scope *queryScope) *statisticQuery {
+	return &statisticQuery{
+		statistic:   statistic,
+		mode:        params.mode,
+		quantile:    quantile,
+		scope:       scope,
+		startTime:   params.startTime,
+		endTime:     params.endTime,
+		extraParams: params.thanosParams,
+	}
+}
+
+// Return the key that will hold the result of the query in the returned JSON data structure
+func (query *statisticQuery) jsonKey() string {
+	if query.quantile != nil {
+		return quantileJSONKey(query.statistic.Key, *query.quantile)
+	}
+	return query.statistic.Key
+}
+
+// Return whether the result of the query is a cumulative count
+func (query *statisticQuery) isCumulative() bool {
+	return query.quantile == nil && query.statistic.Query.isCounter() && query.mode == modeCumulative
+}
+
+// Information about the backend results used to respond to a single API call, which is returned to the caller
+// This is not safe for concurrent use
+type upstreamInfo struct {
+	sources  map[string]bool // the source of each result, such as the base URL of each Prometheus server that sent a response
+	warnings map[string]bool // the warnings in all the results
+}
+
+func newUpstreamInfo() *upstreamInfo {
+	return &upstreamInfo{sources: make(map[string]bool), warnings: make(map[string]bool)}
+}
+
+// Add the information about a single result
+func (info *upstreamInfo) add(source string, warnings []string) {
+	if source != "" {
+		info.sources[source] = true
+	}
+	for _, warning := range warnings {
+		info.warnings[warning] = true
+	}
+}
+
+// Return the source of each result, sorted
+func (info *upstreamInfo) sourceList() []string {
+	return sortedKeys(info.sources)
+}
+
+// Return the distinct warnings in all the results, sorted, or nil if there were none
+func (info *upstreamInfo) warningList() []string {
+	if len(info.warnings) == 0 {
+		return nil
+	}
+	return sortedKeys(info.warnings)
+}
+
+// Return the keys of the specified map as a sorted array
+func sortedKeys(set map[string]bool) []string {
+	sorted := make([]string, 0, len(set))
+	for key := range set {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
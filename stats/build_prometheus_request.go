@@ -1,6 +1,38 @@
 package stats
 
-// Prometheus metrics to use, keyed by metric type
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scope of a Prometheus query for a single statistic
+type queryScope struct {
+	appName      string        // if not empty, only select metrics for this application
+	routeName    string        // if not empty, only select metrics for this route
+	instanceName string        // if not empty, only select metrics from this Fn server
+	groupByLabel string        // if not empty, return a separate result for each value of this label
+	window       time.Duration // the period over which rolling statistics are calculated
+	step         time.Duration // the interval between values
+}
+
+// A function that knows how to build a Prometheus query for the specified metric and scope
+type queryBuilderFunc func(promMetricName string, scope *queryScope) string
+
+// A Prometheus label matcher, such as fn_appname="myapp"
+type labelMatcher struct {
+	label string
+	value string
+}
+
+// A Prometheus instant vector selector, such as fn_calls{fn_appname="myapp"}
+type vectorSelector struct {
+	metricName string
+	matchers   []labelMatcher
+}
+
+// Prometheus metrics used by the built-in statistics, keyed by metric type
 // see comment in statistics.go for information on adding a new metric
 var promMetricNames = map[int]string{
 	completedConst: "fn_completed",
@@ -11,55 +43,152 @@ var promMetricNames = map[int]string{
 	runningConst:   "fn_running", // used for tests only
 	queuedConst:    "fn_queued",  // used for tests only
 	durationsConst: "fn_span_agent_submit_duration_seconds",
+	// for ratios, this is the numerator (the denominator is always fn_calls)
+	errorRatioConst:   "fn_errors",
+	timeoutRatioConst: "fn_timeouts",
+	successRatioConst: "fn_completed",
 }
 
-// Functions that know how to build the required Prometheus query, keyed by metric type
-// see comment in statistics.go for information on adding a new metric
-var queryBuilders = map[int]func(string, string, string, string, string, string, string, string) string{
-	completedConst: queryBuilderForCountersAndGauges,
-	failedConst:    queryBuilderForCountersAndGauges,
-	callsConst:     queryBuilderForCountersAndGauges,
-	errorsConst:    queryBuilderForCountersAndGauges,
-	timedoutConst:  queryBuilderForCountersAndGauges,
-	durationsConst: queryBuilderForHistograms,
+// Construct the URL for a range query for the specified metric and scope
+// The URL is relative to the base URL of Prometheus, so that it can be sent to any of the configured Prometheus servers
+// extraParams contains any additional parameters to pass to Prometheus, such as those supported by Thanos
+func buildPrometheusRequest(queryBuilder queryBuilderFunc, promMetricName string, scope *queryScope, startTimeString string, endTimeString string, extraParams url.Values) string {
+	// use the specified queryBuilder function to construct a Prometheus query for the required metric
+	query := queryBuilder(promMetricName, scope)
+	// construct the request URL, including the time range and step
+	values := copyValues(extraParams)
+	values.Set("query", query)
+	values.Set("start", startTimeString)
+	values.Set("end", endTimeString)
+	values.Set("step", promDuration(scope.step))
+	return "/api/v1/query_range?" + values.Encode()
 }
 
-func buildPrometheusRequest(queryBuilder func(string, string, string, string, string, string, string, string) string, promHost string, promPort string, metricType int, appName string, routeName string, startTimeString string, endTimeString string, stepString string) string {
-	promMetricName := promMetricNames[metricType]
-	// use the specified queryBuilder function to construct a Prometheus query for the required metric
-	query := queryBuilder(promHost, promPort, promMetricName, appName, routeName, startTimeString, endTimeString, stepString)
-	// construct the complete request URL, including host, port, time range and step
-	return "http://" + promHost + ":" + promPort + "/api/v1/query_range?query=" + query + "&start=" + startTimeString + "&end=" + endTimeString + "&step=" + stepString
+// Construct the URL for an instant query, which evaluates the specified Prometheus query at a single time
+// The URL is relative to the base URL of Prometheus, and may contain additional parameters, in the same way as buildPrometheusRequest
+func buildPrometheusInstantRequest(query string, timeString string, extraParams url.Values) string {
+	values := copyValues(extraParams)
+	values.Set("query", query)
+	values.Set("time", timeString)
+	return "/api/v1/query?" + values.Encode()
+}
+
+// Return a copy of the specified URL query parameters, which may be nil
+func copyValues(values url.Values) url.Values {
+	copied := url.Values{}
+	for name, value := range values {
+		copied[name] = append([]string(nil), value...)
+	}
+	return copied
+}
+
+func queryBuilderForCountersAndGauges(promMetricName string, scope *queryScope) string {
+	return sumBy(scope.selector(promMetricName).String(), scope.groupByLabel)
+}
+
+func queryBuilderForHistograms(promMetricName string, scope *queryScope) string {
+	numerator := sumBy("rate("+scope.selector(promMetricName+"_sum").over(scope.window)+")", scope.groupByLabel)
+	denominator := sumBy("rate("+scope.selector(promMetricName+"_count").over(scope.window)+")", scope.groupByLabel)
+	return numerator + "/" + denominator
+}
+
+// Return a function that builds a query for a gauge metric, which combines the values from each application, route and Fn server
+// using the specified Prometheus aggregation operator (sum, avg, min or max)
+func queryBuilderForAggregation(aggregation string) queryBuilderFunc {
+	return func(promMetricName string, scope *queryScope) string {
+		return aggregateBy(aggregation, scope.selector(promMetricName).String(), scope.groupByLabel)
+	}
+}
+
+// Build a query for the ratio of the rate of increase of a counter metric to the rate of increase of fn_calls,
+// calculated over the window
+func queryBuilderForRatios(promMetricName string, scope *queryScope) string {
+	numerator := sumBy("rate("+scope.selector(promMetricName).over(scope.window)+")", scope.groupByLabel)
+	denominator := sumBy("rate("+scope.selector(promMetricNames[callsConst]).over(scope.window)+")", scope.groupByLabel)
+	return numerator + "/" + denominator
+}
+
+// Return a function that builds a query for the specified quantile (a value between 0 and 1) of a histogram metric
+// The quantile is calculated from the histogram buckets over the window, in the same way as the mean
+func queryBuilderForHistogramQuantile(quantile float64) queryBuilderFunc {
+	return func(promMetricName string, scope *queryScope) string {
+		quantileString := strconv.FormatFloat(quantile, 'f', -1, 64)
+		buckets := sumBy("rate("+scope.selector(promMetricName+"_bucket").over(scope.window)+")", "le", scope.groupByLabel)
+		return "histogram_quantile(" + quantileString + "," + buckets + ")"
+	}
 }
 
-func queryBuilderForCountersAndGauges(promHost string, promPort string, promMetricName string, appName string, routeName string, startTimeString string, endTimeString string, stepString string) string {
+// Return a function that builds a query for a counter metric in the specified mode (modeRate or modeIncrease)
+// These use the Prometheus rate and increase functions, which allow for counters being reset when a Fn server restarts
+func queryBuilderForCounterMode(mode string) queryBuilderFunc {
+	return func(promMetricName string, scope *queryScope) string {
+		// a rate is calculated over the window, an increase is calculated over a single step
+		if mode == modeRate {
+			return sumBy("rate("+scope.selector(promMetricName).over(scope.window)+")", scope.groupByLabel)
+		}
+		return sumBy("increase("+scope.selector(promMetricName).over(scope.step)+")", scope.groupByLabel)
+	}
+}
+
+// Return a selector for the specified metric, with label matchers for the application, route and instance of this scope
+func (scope *queryScope) selector(metricName string) vectorSelector {
+	var matchers []labelMatcher
+	if scope.appName != "" {
+		matchers = append(matchers, labelMatcher{label: appLabel, value: scope.appName})
+	}
+	if scope.routeName != "" {
+		matchers = append(matchers, labelMatcher{label: routeLabel, value: scope.routeName})
+	}
+	if scope.instanceName != "" {
+		matchers = append(matchers, labelMatcher{label: instanceLabel, value: scope.instanceName})
+	}
+	return vectorSelector{metricName: metricName, matchers: matchers}
+}
 
-	if appName == "" {
-		return "sum(" + promMetricName + ")"
-	} else if routeName == "" {
-		qualifiedPromMetricName := promMetricName + "{" + appLabel + "=\"" + appName + "\"}"
-		return "sum(" + qualifiedPromMetricName + ")"
-	} else {
-		qualifiedPromMetricName := promMetricName + "{" + appLabel + "=\"" + appName + "\"," + routeLabel + "=\"" + routeName + "\"}"
-		return "sum(" + qualifiedPromMetricName + ")"
+// Return the selector in PromQL form
+// Label values are quoted and escaped, so that they cannot alter the meaning of the query
+func (selector vectorSelector) String() string {
+	if len(selector.matchers) == 0 {
+		return selector.metricName
 	}
+	matcherStrings := make([]string, len(selector.matchers))
+	for i, matcher := range selector.matchers {
+		// PromQL string literals use the same escape sequences as Go
+		matcherStrings[i] = matcher.label + "=" + strconv.Quote(matcher.value)
+	}
+	return selector.metricName + "{" + strings.Join(matcherStrings, ",") + "}"
+}
 
+// Return a range vector selector over the specified duration, such as fn_calls{fn_appname="myapp"}[60s]
+func (selector vectorSelector) over(d time.Duration) string {
+	return selector.String() + "[" + promDuration(d) + "]"
 }
 
-func queryBuilderForHistograms(promHost string, promPort string, promMetricName string, appName string, routeName string, startTimeString string, endTimeString string, stepString string) string {
+// Wrap the specified expression in a Prometheus sum, grouped by the specified labels (empty labels are ignored)
+func sumBy(expression string, labels ...string) string {
+	return aggregateBy(aggregationSum, expression, labels...)
+}
+
+// Wrap the specified expression in a Prometheus aggregation operator such as sum or max,
+// grouped by the specified labels (empty labels are ignored)
+func aggregateBy(operator string, expression string, labels ...string) string {
+	var byLabels []string
+	for _, label := range labels {
+		if label != "" {
+			byLabels = append(byLabels, label)
+		}
+	}
+	if len(byLabels) == 0 {
+		return operator + "(" + expression + ")"
+	}
+	return operator + "(" + expression + ")by(" + strings.Join(byLabels, ",") + ")"
+}
 
-	rollingMeanPeriod := "1m"
-	if appName == "" {
-		numerator := "sum(rate(" + promMetricName + "_sum[" + rollingMeanPeriod + "]))"
-		denominator := "sum(rate(" + promMetricName + "_count[" + rollingMeanPeriod + "]))"
-		return numerator + "/" + denominator
-	} else if routeName == "" {
-		numerator := "sum(rate(" + promMetricName + "_sum{" + appLabel + "=\"" + appName + "\"}[" + rollingMeanPeriod + "]))"
-		denominator := "sum(rate(" + promMetricName + "_count{" + appLabel + "=\"" + appName + "\"}[" + rollingMeanPeriod + "]))"
-		return numerator + "/" + denominator
-	} else {
-		numerator := "sum(rate(" + promMetricName + "_sum{" + appLabel + "=\"" + appName + "\"," + routeLabel + "=\"" + routeName + "\"}[" + rollingMeanPeriod + "]))"
-		denominator := "sum(rate(" + promMetricName + "_count{" + appLabel + "=\"" + appName + "\"," + routeLabel + "=\"" + routeName + "\"}[" + rollingMeanPeriod + "]))"
-		return numerator + "/" + denominator
+// Convert a duration to a form that Prometheus accepts in a range selector, such as 90s
+// (Prometheus does not accept the compound form, such as 1m30s, produced by time.Duration.String)
+func promDuration(d time.Duration) string {
+	if d%time.Second != 0 {
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
 	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
 }
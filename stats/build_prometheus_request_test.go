@@ -0,0 +1,231 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests check the construction of Prometheus queries and do not require an Fn server or Prometheus
+
+// Application and route names that would break, or alter the meaning of, a query if not escaped
+var hostileNames = []string{
+	`my"app`,
+	`my\app`,
+	`my"}or vector(1)#`,
+	`my{app}`,
+	"my\napp",
+	`my&query=up`,
+	`my app+1%20`,
+}
+
+func TestSelectorEscapesLabelValues(t *testing.T) {
+	scope := &queryScope{appName: `my"app\`, routeName: `/r}`}
+	assertStringsEqual(t, "selector", `fn_calls{fn_appname="my\"app\\",fn_path="/r}"}`, scope.selector("fn_calls").String())
+	assertStringsEqual(t, "range selector", `fn_calls{fn_appname="my\"app\\",fn_path="/r}"}[60s]`, scope.selector("fn_calls").over(time.Minute))
+}
+
+func TestSelectorWithoutScope(t *testing.T) {
+	scope := &queryScope{}
+	assertStringsEqual(t, "selector", "fn_calls", scope.selector("fn_calls").String())
+	assertStringsEqual(t, "counter query", "sum(fn_calls)", queryBuilderForCountersAndGauges("fn_calls", scope))
+}
+
+func TestHostileNamesRoundTrip(t *testing.T) {
+	for _, name := range hostileNames {
+		scope := &queryScope{appName: name, routeName: "/" + name}
+		selector := scope.selector("fn_calls").String()
+
+		// the selector must consist of the metric name and exactly two quoted label values, which unquote to the original names
+		assertIntsEqual(t, "number of opening braces outside label values in "+selector, 1, strings.Count(removeQuotedStrings(t, selector), "{"))
+		prefix := "fn_calls{" + appLabel + "="
+		if !strings.HasPrefix(selector, prefix) {
+			t.Fatal("selector " + selector + " does not start with " + prefix)
+		}
+		appValue := quotedPrefix(t, selector[len(prefix):])
+		unquotedAppValue, err := strconv.Unquote(appValue)
+		assertNoError(t, "unquoting application name in "+selector, err)
+		assertStringsEqual(t, "application name", name, unquotedAppValue)
+
+		rest := selector[len(prefix)+len(appValue):]
+		routePrefix := "," + routeLabel + "="
+		if !strings.HasPrefix(rest, routePrefix) {
+			t.Fatal("selector " + selector + " does not contain " + routePrefix + " after the application name")
+		}
+		routeValue := quotedPrefix(t, rest[len(routePrefix):])
+		unquotedRouteValue, err := strconv.Unquote(routeValue)
+		assertNoError(t, "unquoting route name in "+selector, err)
+		assertStringsEqual(t, "route name", "/"+name, unquotedRouteValue)
+		assertStringsEqual(t, "end of selector", "}", rest[len(routePrefix)+len(routeValue):])
+	}
+}
+
+func TestBuildPrometheusRequestEncodesParameters(t *testing.T) {
+	for _, name := range hostileNames {
+		scope := &queryScope{appName: name, routeName: "/" + name, window: time.Minute, step: 90 * time.Second}
+		startTimeString := "2017-11-24T18:01:30.851+01:00"
+		endTimeString := "2017-11-24T18:11:30.849+01:00"
+		for _, statistic := range builtinStatistics {
+			queryBuilder := statistic.Query.queryBuilder()
+			requestURL := buildPrometheusRequest(queryBuilder, statistic.Metric, scope, startTimeString, endTimeString, nil)
+
+			parsedURL, err := url.Parse(requestURL)
+			assertNoError(t, "parsing "+requestURL, err)
+			assertStringsEqual(t, "host", "", parsedURL.Host)
+			assertStringsEqual(t, "path", "/api/v1/query_range", parsedURL.Path)
+
+			// the query and other parameters must be received by Prometheus exactly as built, with no extra parameters
+			values := parsedURL.Query()
+			assertIntsEqual(t, "number of parameters in "+requestURL, 4, len(values))
+			assertStringsEqual(t, "query", queryBuilder(statistic.Metric, scope), values.Get("query"))
+			assertStringsEqual(t, "start", startTimeString, values.Get("start"))
+			assertStringsEqual(t, "end", endTimeString, values.Get("end"))
+			assertStringsEqual(t, "step", "90s", values.Get("step"))
+		}
+	}
+}
+
+func TestBuildPrometheusInstantRequestEncodesParameters(t *testing.T) {
+	scope := &queryScope{appName: `my&app="x"`, window: 5 * time.Minute}
+	query := buildTopQuery(topByErrorRatio, 0, 3, scope)
+	requestURL := buildPrometheusInstantRequest(query, "2017-11-24T18:11:30.849+01:00", nil)
+
+	parsedURL, err := url.Parse(requestURL)
+	assertNoError(t, "parsing "+requestURL, err)
+	assertStringsEqual(t, "path", "/api/v1/query", parsedURL.Path)
+	values := parsedURL.Query()
+	assertIntsEqual(t, "number of parameters in "+requestURL, 2, len(values))
+	assertStringsEqual(t, "query", query, values.Get("query"))
+	assertStringsEqual(t, "time", "2017-11-24T18:11:30.849+01:00", values.Get("time"))
+}
+
+// Return the specified PromQL with the contents of all double-quoted strings removed
+func removeQuotedStrings(t *testing.T, promQL string) string {
+	var result bytes.Buffer
+	for len(promQL) > 0 {
+		if promQL[0] != '"' {
+			result.WriteByte(promQL[0])
+			promQL = promQL[1:]
+			continue
+		}
+		quoted := quotedPrefix(t, promQL)
+		promQL = promQL[len(quoted):]
+	}
+	return result.String()
+}
+
+// Return the double-quoted string, including any escaped characters, at the start of the specified PromQL
+func quotedPrefix(t *testing.T, promQL string) string {
+	if len(promQL) == 0 || promQL[0] != '"' {
+		t.Fatal("expected a quoted string at the start of " + promQL)
+	}
+	for i := 1; i < len(promQL); i++ {
+		switch promQL[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '"':
+			return promQL[:i+1]
+		}
+	}
+	t.Fatal("unterminated quoted string " + promQL)
+	return ""
+}
+
+// Return the value of the query parameter of the specified request URL, after sending it over HTTP,
+// failing if the request line is malformed (such as if the URL contains a space)
+func sentQuery(t *testing.T, requestURL string) string {
+	request, err := http.NewRequest("GET", requestURL, nil)
+	assertNoError(t, "creating request for "+requestURL, err)
+	var buffer bytes.Buffer
+	assertNoError(t, "writing request for "+requestURL, request.Write(&buffer))
+	received, err := http.ReadRequest(bufio.NewReader(&buffer))
+	assertNoError(t, "reading request for "+requestURL, err)
+	assertStringsEqual(t, "protocol of request for "+requestURL, "HTTP/1.1", received.Proto)
+	return received.URL.Query().Get("query")
+}
+
+func TestQuantileRequest(t *testing.T) {
+	scope := &queryScope{appName: "myapp", routeName: "/hello", window: time.Minute, step: 30 * time.Second}
+	requestURL := buildPrometheusRequest(queryBuilderForHistogramQuantile(0.99), promMetricNames[durationsConst], scope, "1500000000", "1500000300", nil)
+	expected := `histogram_quantile(0.99,sum(rate(fn_span_agent_submit_duration_seconds_bucket{fn_appname="myapp",fn_path="/hello"}[60s]))by(le))`
+	assertStringsEqual(t, "query", expected, sentQuery(t, "http://localhost:9090"+requestURL))
+}
+
+func TestGroupedRequest(t *testing.T) {
+	scope := &queryScope{appName: "myapp", groupByLabel: routeLabel, window: time.Minute, step: 30 * time.Second}
+	requestURL := buildPrometheusRequest(queryBuilderForCountersAndGauges, promMetricNames[callsConst], scope, "1500000000", "1500000300", nil)
+	assertStringsEqual(t, "query", `sum(fn_calls{fn_appname="myapp"})by(fn_path)`, sentQuery(t, "http://localhost:9090"+requestURL))
+}
+
+func TestCounterModeQueries(t *testing.T) {
+	scope := &queryScope{appName: "myapp", window: time.Minute, step: 30 * time.Second}
+	tests := []struct {
+		query    string
+		jsonKey  string
+		expected string
+	}{
+		{"", "calls", `sum(fn_calls{fn_appname="myapp"})`},
+		{"mode=cumulative", "calls", `sum(fn_calls{fn_appname="myapp"})`},
+		// a rate is calculated over the window, an increase over the step
+		{"mode=rate", "calls", `sum(rate(fn_calls{fn_appname="myapp"}[60s]))`},
+		{"mode=increase", "errors", `sum(increase(fn_errors{fn_appname="myapp"}[30s]))`},
+		// the mode only applies to counters
+		{"mode=rate", "durations", queryBuilderForHistograms(promMetricNames[durationsConst], scope)},
+		{"mode=increase", "error_ratio", queryBuilderForRatios(builtinStatistics[errorRatioConst].Metric, scope)},
+	}
+	for _, test := range tests {
+		params, err := getQueryParams(httptest.NewRequest("GET", "/v1/apps/myapp/stats?"+test.query, nil))
+		assertNoError(t, "getting query parameters for "+test.query, err)
+		query := params.statisticQueries(scope)[test.jsonKey]
+		requestURL := buildPrometheusRequest(query.promQueryBuilder(), query.statistic.Metric, scope, "1500000000", "1500000300", nil)
+		assertStringsEqual(t, "query for "+test.jsonKey+" with "+test.query, test.expected, sentQuery(t, "http://localhost:9090"+requestURL))
+	}
+
+	for _, query := range []string{"mode=total", "mode=", "mode=Rate"} {
+		if _, err := getQueryParams(httptest.NewRequest("GET", "/v1/stats?"+query, nil)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestGroupedByAppRequest(t *testing.T) {
+	scope := &queryScope{groupByLabel: appLabel, window: time.Minute, step: 30 * time.Second}
+	requestURL := buildPrometheusRequest(queryBuilderForCountersAndGauges, promMetricNames[callsConst], scope, "1500000000", "1500000300", nil)
+	assertStringsEqual(t, "query", `sum(fn_calls)by(fn_appname)`, sentQuery(t, "http://localhost:9090"+requestURL))
+	requestURL = buildPrometheusRequest(queryBuilderForCounterMode(modeRate), promMetricNames[callsConst], scope, "1500000000", "1500000300", nil)
+	assertStringsEqual(t, "rate query", `sum(rate(fn_calls[60s]))by(fn_appname)`, sentQuery(t, "http://localhost:9090"+requestURL))
+}
+
+func TestThanosParams(t *testing.T) {
+
+	savedDefaults := defaultThanosParams
+	defer func() { defaultThanosParams = savedDefaults }()
+	defaultThanosParams = url.Values{thanosDedup: []string{"false"}, thanosPartialResponse: []string{"true"}}
+
+	// parameters in the request override the configured defaults, and are passed through in the form expected by Thanos
+	r := httptest.NewRequest("GET", "/v1/stats?dedup=1&max_source_resolution=5m", nil)
+	params, err := getQueryParams(r)
+	assertNoError(t, "getting query parameters", err)
+	scope := &queryScope{window: time.Minute, step: time.Minute}
+	requestURL := buildPrometheusRequest(queryBuilderForCountersAndGauges, "fn_calls", scope, params.startTimeString, params.endTimeString, params.thanosParams)
+
+	parsedURL, err := url.Parse(requestURL)
+	assertNoError(t, "parsing "+requestURL, err)
+	values := parsedURL.Query()
+	assertStringsEqual(t, thanosDedup, "true", values.Get(thanosDedup))
+	assertStringsEqual(t, thanosPartialResponse, "true", values.Get(thanosPartialResponse))
+	assertStringsEqual(t, thanosMaxSourceResolution, "300s", values.Get(thanosMaxSourceResolution))
+	assertStringsEqual(t, "configured defaults", "false", defaultThanosParams.Get(thanosDedup))
+
+	for _, query := range []string{"dedup=maybe", "partial_response=", "max_source_resolution=-5m", "max_source_resolution=raw"} {
+		if _, err := getQueryParams(httptest.NewRequest("GET", "/v1/stats?"+query, nil)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
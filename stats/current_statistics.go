@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fnproject/fn/api/models"
+	"net/http"
+)
+
+// The current statistics API returns a single value for each statistic, obtained using a Prometheus instant query
+// (or the equivalent query of another queryBackend), rather than a range of values
+
+type globalCurrentStatisticsHandler struct{}
+type appCurrentStatisticsHandler struct{}
+type routeCurrentStatisticsHandler struct{}
+
+func (h *globalCurrentStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	jsonData := handleCurrent(r, "", "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (h *appCurrentStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, app *models.App) {
+	jsonData := handleCurrent(r, app.Name, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (h *routeCurrentStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, app *models.App, route *models.Route) {
+	jsonData := handleCurrent(r, app.Name, route.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// Process the request and return the current value of each requested statistic as JSON
+// The statistics are evaluated at endtime, which defaults to now
+func handleCurrent(r *http.Request, appName string, routeName string) []byte {
+
+	// parse query params and provide default values if needed
+	params, err := getQueryParams(r)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	if params.groupBy != "" {
+		return getErrorAsJSON(errors.New("groupby is not supported when requesting current statistics"))
+	}
+
+	responseStruct := new(currentMetricsResponse)
+	responseStruct.Status = STATS_STATUS_SUCCESS
+	responseStruct.Time = params.endTime.Unix()
+	responseStruct.Data = make(map[string]*float64)
+
+	// the scope of the queries
+	scope := &queryScope{
+		appName:      appName,
+		routeName:    routeName,
+		instanceName: params.instance,
+		window:       params.window,
+		step:         params.step,
+	}
+
+	// construct the query for each requested statistic and quantile, keyed by the name of the key that will hold it in the response
+	queries := params.statisticQueries(scope)
+
+	backend, err := params.backend()
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+
+	// execute the queries concurrently, abandoning them if the caller goes away or if they take too long
+	ctx, cancel := context.WithTimeout(r.Context(), prometheusTimeout)
+	defer cancel()
+	results, err := executeCurrentQueries(ctx, backend, queries)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	info := newUpstreamInfo()
+	for jsonKey, result := range results {
+		responseStruct.Data[jsonKey] = result.value
+		info.add(result.source, result.warnings)
+	}
+	responseStruct.Prometheus = info.sourceList()
+	responseStruct.Warnings = info.warningList()
+
+	jsonData, err := json.Marshal(responseStruct)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	return jsonData
+}
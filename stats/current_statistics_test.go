@@ -0,0 +1,103 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// These tests check the current statistics API using a memoryBackend, or a test server in place of Prometheus
+
+func TestPrometheusCurrentQueries(t *testing.T) {
+
+	var receivedQuery, receivedTime string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedQuery = r.URL.Query().Get("query")
+		receivedTime = r.URL.Query().Get("time")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1500000300,"2.5"]}]}}`))
+	}))
+	defer server.Close()
+
+	savedConnection := promConnection
+	defer func() { promConnection = savedConnection }()
+	var err error
+	promConnection, err = newPrometheusConnection(&prometheusConnectionConfig{baseURLs: []string{server.URL}})
+	assertNoError(t, "creating connection", err)
+
+	scope := &queryScope{appName: "myapp", routeName: "/hello", window: time.Minute, step: 30 * time.Second}
+	quantile := 0.99
+	tests := []struct {
+		name     string
+		query    *statisticQuery
+		expected string
+	}{
+		{"calls", &statisticQuery{statistic: builtinStatistics[callsConst], mode: modeCumulative}, `sum(fn_calls{fn_appname="myapp",fn_path="/hello"})`},
+		{"rate of calls", &statisticQuery{statistic: builtinStatistics[callsConst], mode: modeRate}, `sum(rate(fn_calls{fn_appname="myapp",fn_path="/hello"}[60s]))`},
+		{"increase in errors", &statisticQuery{statistic: builtinStatistics[errorsConst], mode: modeIncrease}, `sum(increase(fn_errors{fn_appname="myapp",fn_path="/hello"}[30s]))`},
+		{"durations_p99", &statisticQuery{statistic: builtinStatistics[durationsConst], quantile: &quantile}, `histogram_quantile(0.99,sum(rate(fn_span_agent_submit_duration_seconds_bucket{fn_appname="myapp",fn_path="/hello"}[60s]))by(le))`},
+	}
+	endTime := time.Unix(1500000300, 0)
+	for _, test := range tests {
+		test.query.scope = scope
+		test.query.endTime = endTime
+		result, err := (&prometheusBackend{}).QueryCurrent(context.Background(), test.query)
+		assertNoError(t, "querying "+test.name, err)
+		assertStringsEqual(t, "query for "+test.name, test.expected, receivedQuery)
+		assertStringsEqual(t, "time for "+test.name, endTime.Format(prometheusTimeFormat), receivedTime)
+		if result.value == nil || *result.value != 2.5 {
+			t.Errorf("Expected %s to be 2.5, got %v", test.name, result.value)
+		}
+		assertStringsEqual(t, "source of "+test.name, server.URL, result.source)
+	}
+}
+
+func TestHandleCurrentAtEndTime(t *testing.T) {
+
+	backend, restore := useMemoryBackend()
+	defer restore()
+	backend.add("calls", "myapp", "", "", metricsTimeValuePair{Time: 1000, Value: 1}, metricsTimeValuePair{Time: 1010, Value: 4})
+	backend.add("calls", "myapp", "", "myhost:8080", metricsTimeValuePair{Time: 1000, Value: 3})
+
+	// each statistic is evaluated at endtime, and is null if there is no value at that time
+	tests := []struct {
+		query    string
+		expected *float64
+	}{
+		{"endtime=999", nil},
+		{"endtime=1000", floatValue(1)},
+		{"endtime=1009", floatValue(1)},
+		{"endtime=1010", floatValue(4)},
+		{"endtime=2000", floatValue(4)},
+		{"endtime=1010&instance=myhost:8080", floatValue(3)},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/v1/apps/myapp/stats/current?metrics=calls&"+test.query, nil)
+		var response currentMetricsResponse
+		assertNoError(t, "parsing response", json.Unmarshal(handleCurrent(r, "myapp", ""), &response))
+		assertStringsEqual(t, "status for "+test.query, STATS_STATUS_SUCCESS, response.Status)
+		value, ok := response.Data["calls"]
+		switch {
+		case !ok:
+			t.Errorf("Expected calls for %s", test.query)
+		case test.expected == nil && value != nil:
+			t.Errorf("Expected calls to be null for %s, got %v", test.query, *value)
+		case test.expected != nil && (value == nil || *value != *test.expected):
+			t.Errorf("Expected calls to be %v for %s, got %v", *test.expected, test.query, value)
+		}
+	}
+
+	for _, query := range []string{"groupby=route", "metrics=bogus", "endtime=soon"} {
+		r := httptest.NewRequest("GET", "/v1/apps/myapp/stats/current?"+query, nil)
+		var response errorResponse
+		assertNoError(t, "parsing response", json.Unmarshal(handleCurrent(r, "myapp", ""), &response))
+		assertStringsEqual(t, "status for "+query, STATS_STATUS_ERROR, response.Status)
+	}
+}
+
+// Return a pointer to the specified value
+func floatValue(value float64) *float64 {
+	return &value
+}
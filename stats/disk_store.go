@@ -0,0 +1,836 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The optional on-disk store used by embeddedBackend, so that samples are kept when the Fn server is restarted
+//
+// Samples are appended to segment files in a single directory, each of which holds the samples for a period of time
+// and is named after that period, such as 1500000000000-1500003600000.seg (in milliseconds since the epoch)
+// A new segment is started every segmentDuration. Once a compaction period (a day) has ended, its segments are compacted
+// into a single segment, and segments that ended more than the retention period ago are deleted
+//
+// A segment consists of segmentMagic followed by a sequence of records, each of which is the length of its payload (uvarint),
+// the payload, and the CRC-32 of the payload (4 bytes, big-endian)
+// The first byte of the payload is the type of the record:
+//   recordSeries defines a series: its id (uvarint), metric name, and label count (uvarint) followed by the name and value of each label,
+//                where each string is its length (uvarint) followed by its bytes
+//   recordBatch contains samples of several series: the count (uvarint), then the id (uvarint), time (varint) and value (8 bytes) of each
+//   recordSamples contains samples of a single series: its id (uvarint), the count (uvarint), then the time (varint) and value (8 bytes) of each
+// Series ids are only meaningful within a segment
+// A truncated or corrupt record, such as one that was being written when the Fn server stopped, ends the segment
+//
+// Each segment is indexed when it is first read, so that subsequent reads only read the records that contain samples
+// in the requested period, and the active segment is indexed as it is written
+
+const (
+	segmentMagic  = "FNSTATS1"
+	segmentSuffix = ".seg"
+	tmpSuffix     = ".tmp"
+
+	recordSeries  = 'S'
+	recordBatch   = 'B'
+	recordSamples = 'P'
+)
+
+// the period of time covered by each segment that samples are appended to
+const segmentDuration = time.Hour
+
+// the period of time covered by a compacted segment
+const compactionDuration = 24 * time.Hour
+
+// the default period for which samples are kept on disk
+const defaultEmbeddedRetention = 15 * 24 * time.Hour
+
+// A directory of segments
+type diskStore struct {
+	dir        string
+	retention  time.Duration
+	mutex      sync.RWMutex   // appending and compacting take the write lock, reading takes the read lock only while opening segments
+	active     *segmentWriter // protected by mutex, the segment that samples are appended to, nil until the first samples are appended
+	indexMutex sync.Mutex
+	indexes    map[string]*cachedIndex // protected by indexMutex, the index of each segment that has been read, keyed by filename
+}
+
+// The index of a segment, together with the file from which it was built
+// A compaction may replace a segment with a file of the same name, so the file is checked before the index is used
+type cachedIndex struct {
+	info  os.FileInfo
+	index *segmentIndex
+}
+
+// The series defined in a segment, and the position and times of each record that contains samples
+type segmentIndex struct {
+	series  map[uint64]*storedSeries // keyed by id, with no samples
+	records []indexedRecord          // in the order in which they appear in the segment
+	length  int64                    // the length of the valid part of the segment, or zero if it does not start with segmentMagic
+}
+
+// The position of a record that contains samples, and the range of times of those samples
+type indexedRecord struct {
+	start   int64  // the position of the first byte of the record
+	end     int64  // the position after the last byte of the record
+	batch   bool   // whether this is a recordBatch, which may contain samples of any series
+	id      uint64 // the series of a recordSamples
+	minTime int64
+	maxTime int64
+}
+
+// A segment that has been opened for reading, and its index if it has already been obtained
+type openedSegment struct {
+	file  *os.File
+	index *segmentIndex
+}
+
+// A segment file and the period of time that it covers
+type segmentFile struct {
+	filename string
+	start    int64 // inclusive, in milliseconds since the epoch
+	end      int64 // exclusive, in milliseconds since the epoch
+}
+
+// A series, as stored in a segment
+type storedSeries struct {
+	metricName string
+	labels     map[string]string
+	samples    sampleList
+}
+
+// A sample to be appended to a segment, together with the series to which it belongs
+type storedSample struct {
+	metricName string
+	labels     map[string]string
+	sample     sample
+}
+
+// The segment that samples are appended to
+type segmentWriter struct {
+	segment segmentFile
+	file    *os.File
+	ids     map[string]uint64 // the id of each series defined in the segment, keyed by seriesKey
+	index   *segmentIndex     // the index of what has been written, whose length is the position of the next record
+}
+
+// Open the store in the specified directory, creating the directory if necessary
+// Any files left behind by a compaction that was interrupted are removed
+func openDiskStore(dir string, retention time.Duration) (*diskStore, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.New("Unable to create statistics directory: " + err.Error())
+	}
+	store := &diskStore{dir: dir, retention: retention, indexes: make(map[string]*cachedIndex)}
+
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpFile := range tmpFiles {
+		if err := os.Remove(tmpFile); err != nil {
+			return nil, errors.New("Unable to remove statistics file: " + err.Error())
+		}
+	}
+
+	// a compaction that was interrupted after writing the compacted segment may have left the segments that it replaced,
+	// which are contained in it
+	segments, err := store.segments()
+	if err != nil {
+		return nil, err
+	}
+	var coveredUntil int64 = math.MinInt64
+	for _, segment := range segments {
+		if segment.end <= coveredUntil {
+			if err := os.Remove(segment.filename); err != nil {
+				return nil, errors.New("Unable to remove statistics file: " + err.Error())
+			}
+			continue
+		}
+		coveredUntil = segment.end
+	}
+	return store, nil
+}
+
+// Append the specified samples, which were all gathered at the specified time
+// A new segment is started when the time passes the end of the current segment, and older segments are then compacted
+func (store *diskStore) append(now int64, samples []storedSample) error {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.active != nil && now < store.active.segment.start {
+		// the clock has gone backwards, so the samples cannot be appended in order
+		return nil
+	}
+	if store.active == nil || now >= store.active.segment.end {
+		segmentStart := floorMillis(now, segmentDuration)
+		writer, err := openSegmentWriter(store.segmentFile(segmentStart, segmentStart+int64(segmentDuration/time.Millisecond)))
+		if err != nil {
+			return err
+		}
+		if store.active != nil {
+			store.active.file.Close()
+		}
+		store.active = writer
+		if err := store.compact(now); err != nil {
+			return err
+		}
+	}
+	return store.active.write(samples)
+}
+
+// Return the samples whose time is after from and not after to of each series with one of the specified metric names
+// (or with any metric name if metricNames is nil) that is selected by the scope, keyed by metric name
+func (store *diskStore) read(metricNames []string, scope *queryScope, from int64, to int64) (map[string][]seriesSamples, error) {
+
+	var wanted map[string]bool
+	if metricNames != nil {
+		wanted = make(map[string]bool)
+		for _, metricName := range metricNames {
+			wanted[metricName] = true
+		}
+	}
+	include := func(metricName string, labels map[string]string) bool {
+		return (wanted == nil || wanted[metricName]) && scope.matches(labels)
+	}
+
+	segments, err := store.openSegments(from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, segment := range segments {
+			segment.file.Close()
+		}
+	}()
+
+	merged := make(map[string]*storedSeries)
+	for _, segment := range segments {
+		index := segment.index
+		if index == nil {
+			if index, err = store.segmentIndex(segment.file); err != nil {
+				return nil, err
+			}
+		}
+		series, err := index.read(segment.file, include, from, to)
+		if err != nil {
+			return nil, err
+		}
+		mergeSeries(merged, series)
+	}
+
+	data := make(map[string][]seriesSamples)
+	for _, series := range merged {
+		data[series.metricName] = append(data[series.metricName], seriesSamples{labels: series.labels, samples: series.samples})
+	}
+	return data, nil
+}
+
+// Open the segments that contain samples whose time is after from and not after to, in order
+// The segments are opened while holding the read lock, so that a compaction cannot remove them first, but are read
+// after it has been released, so that appending is not delayed (an open segment can still be read after it is removed)
+// The index of the active segment is copied while holding the lock, and the indexes of the other segments are obtained later
+func (store *diskStore) openSegments(from int64, to int64) ([]openedSegment, error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	segments, err := store.segments()
+	if err != nil {
+		return nil, err
+	}
+	store.removeCachedIndexes(segments)
+
+	var opened []openedSegment
+	for _, segment := range segments {
+		if segment.end <= from || segment.start > to {
+			continue
+		}
+		file, err := os.Open(segment.filename)
+		if err != nil {
+			for _, o := range opened {
+				o.file.Close()
+			}
+			return nil, errors.New("Unable to open statistics file: " + err.Error())
+		}
+		o := openedSegment{file: file}
+		if store.active != nil && store.active.segment.filename == segment.filename {
+			o.index = store.active.index.snapshot()
+		}
+		opened = append(opened, o)
+	}
+	return opened, nil
+}
+
+// Return the index of the specified segment, which is not the active segment, indexing it if it has not been read before
+func (store *diskStore) segmentIndex(file *os.File) (*segmentIndex, error) {
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.New("Unable to read statistics file: " + err.Error())
+	}
+	store.indexMutex.Lock()
+	cached, ok := store.indexes[file.Name()]
+	store.indexMutex.Unlock()
+	if ok && os.SameFile(cached.info, info) && cached.info.Size() == info.Size() && cached.info.ModTime().Equal(info.ModTime()) {
+		return cached.index, nil
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, errors.New("Unable to read statistics file: " + err.Error())
+	}
+	index := indexSegment(data)
+	store.indexMutex.Lock()
+	store.indexes[file.Name()] = &cachedIndex{info: info, index: index}
+	store.indexMutex.Unlock()
+	return index, nil
+}
+
+// Remove the cached index of each segment that is not one of the specified segments, which are those that still exist
+func (store *diskStore) removeCachedIndexes(segments []segmentFile) {
+
+	existing := make(map[string]bool)
+	for _, segment := range segments {
+		existing[segment.filename] = true
+	}
+	store.indexMutex.Lock()
+	defer store.indexMutex.Unlock()
+	for filename := range store.indexes {
+		if !existing[filename] {
+			delete(store.indexes, filename)
+		}
+	}
+}
+
+// Compact the segments of each compaction period that has ended into a single segment, and delete segments that ended
+// more than the retention period ago
+// The caller must hold the write lock
+func (store *diskStore) compact(now int64) error {
+
+	segments, err := store.segments()
+	if err != nil {
+		return err
+	}
+	expiry := now - int64(store.retention/time.Millisecond)
+	currentPeriod := floorMillis(now, compactionDuration)
+
+	periods := make(map[int64][]segmentFile)
+	for _, segment := range segments {
+		if segment.end <= expiry {
+			if err := os.Remove(segment.filename); err != nil {
+				return errors.New("Unable to remove statistics file: " + err.Error())
+			}
+			continue
+		}
+		if period := floorMillis(segment.start, compactionDuration); period < currentPeriod {
+			periods[period] = append(periods[period], segment)
+		}
+	}
+
+	for period, periodSegments := range periods {
+		compacted := store.segmentFile(period, period+int64(compactionDuration/time.Millisecond))
+		if len(periodSegments) == 1 && periodSegments[0] == compacted {
+			continue
+		}
+		if err := compactSegments(periodSegments, compacted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the samples of the specified segments to a single compacted segment, ordered by series, and delete the segments
+func compactSegments(segments []segmentFile, compacted segmentFile) error {
+
+	merged := make(map[string]*storedSeries)
+	includeAll := func(string, map[string]string) bool { return true }
+	for _, segment := range segments {
+		series, err := readSegment(segment.filename, includeAll, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		mergeSeries(merged, series)
+	}
+
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := []byte(segmentMagic)
+	for i, key := range keys {
+		series := merged[key]
+		data = appendRecord(data, seriesRecord(uint64(i), series.metricName, series.labels))
+		data = appendRecord(data, samplesRecord(uint64(i), series.samples))
+	}
+
+	// the compacted segment replaces the others atomically, so that an interrupted compaction loses no samples
+	tmpFilename := compacted.filename + tmpSuffix
+	if err := writeFileSync(tmpFilename, data); err != nil {
+		return errors.New("Unable to write statistics file: " + err.Error())
+	}
+	if err := os.Rename(tmpFilename, compacted.filename); err != nil {
+		return errors.New("Unable to write statistics file: " + err.Error())
+	}
+	for _, segment := range segments {
+		if segment.filename != compacted.filename {
+			if err := os.Remove(segment.filename); err != nil {
+				return errors.New("Unable to remove statistics file: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Return the segments in the directory, sorted by start time, with longer segments first if they start at the same time
+func (store *diskStore) segments() ([]segmentFile, error) {
+
+	filenames, err := filepath.Glob(filepath.Join(store.dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var segments []segmentFile
+	for _, filename := range filenames {
+		times := strings.Split(strings.TrimSuffix(filepath.Base(filename), segmentSuffix), "-")
+		if len(times) != 2 {
+			continue
+		}
+		start, startErr := strconv.ParseInt(times[0], 10, 64)
+		end, endErr := strconv.ParseInt(times[1], 10, 64)
+		if startErr != nil || endErr != nil || end <= start {
+			continue
+		}
+		segments = append(segments, segmentFile{filename: filename, start: start, end: end})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].start != segments[j].start {
+			return segments[i].start < segments[j].start
+		}
+		return segments[i].end > segments[j].end
+	})
+	return segments, nil
+}
+
+// Return the segment in the directory that covers the specified period
+func (store *diskStore) segmentFile(start int64, end int64) segmentFile {
+	filename := filepath.Join(store.dir, strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+segmentSuffix)
+	return segmentFile{filename: filename, start: start, end: end}
+}
+
+// Open the specified segment for appending, creating it if necessary
+// If it already exists, any truncated or corrupt records at its end are removed
+func openSegmentWriter(segment segmentFile) (*segmentWriter, error) {
+
+	data, err := ioutil.ReadFile(segment.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	writer := &segmentWriter{segment: segment, ids: make(map[string]uint64), index: indexSegment(data)}
+	for id, s := range writer.index.series {
+		writer.ids[seriesKey(s.metricName, s.labels)] = id
+	}
+
+	writer.file, err = os.OpenFile(segment.filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.New("Unable to open statistics file: " + err.Error())
+	}
+	if writer.index.length == 0 {
+		// the segment is new, or its header is corrupt
+		writer.ids = make(map[string]uint64)
+		writer.index = &segmentIndex{series: make(map[uint64]*storedSeries), length: int64(len(segmentMagic))}
+		err = writer.file.Truncate(0)
+		if err == nil {
+			_, err = writer.file.Write([]byte(segmentMagic))
+		}
+	} else {
+		err = writer.file.Truncate(writer.index.length)
+		if err == nil {
+			_, err = writer.file.Seek(writer.index.length, io.SeekStart)
+		}
+	}
+	if err != nil {
+		writer.file.Close()
+		return nil, errors.New("Unable to write statistics file: " + err.Error())
+	}
+	return writer, nil
+}
+
+// Append the specified samples to the segment, defining any series that have not been defined already
+// The series are only added to the ids and the index once they have been written, and if the write fails
+// any part of it that was written is removed, so that it does not end the segment
+func (writer *segmentWriter) write(samples []storedSample) error {
+
+	newIDs := make(map[string]uint64)
+	newSeries := make(map[uint64]*storedSeries)
+	record := indexedRecord{batch: true, minTime: math.MaxInt64, maxTime: math.MinInt64}
+	var data, batch []byte
+	for _, s := range samples {
+		key := seriesKey(s.metricName, s.labels)
+		id, ok := writer.ids[key]
+		if !ok {
+			id, ok = newIDs[key]
+		}
+		if !ok {
+			id = uint64(len(writer.ids) + len(newIDs))
+			newIDs[key] = id
+			newSeries[id] = &storedSeries{metricName: s.metricName, labels: s.labels}
+			data = appendRecord(data, seriesRecord(id, s.metricName, s.labels))
+		}
+		batch = appendUvarint(batch, id)
+		batch = appendSample(batch, s.sample)
+		record.addTime(s.sample.time)
+	}
+	payload := append([]byte{recordBatch}, appendUvarint(nil, uint64(len(samples)))...)
+	record.start = writer.index.length + int64(len(data))
+	data = appendRecord(data, append(payload, batch...))
+	record.end = writer.index.length + int64(len(data))
+
+	if _, err := writer.file.Write(data); err != nil {
+		if truncateErr := writer.file.Truncate(writer.index.length); truncateErr == nil {
+			writer.file.Seek(writer.index.length, io.SeekStart)
+		}
+		return errors.New("Unable to write statistics file: " + err.Error())
+	}
+
+	for key, id := range newIDs {
+		writer.ids[key] = id
+		writer.index.series[id] = newSeries[id]
+	}
+	if len(samples) > 0 {
+		writer.index.records = append(writer.index.records, record)
+	}
+	writer.index.length = record.end
+	return nil
+}
+
+// Read the segment in the specified file, returning the series whose metric name and labels are accepted by include,
+// keyed by id, with their samples whose time is after from and not after to
+func readSegment(filename string, include func(metricName string, labels map[string]string) bool, from int64, to int64) (map[uint64]*storedSeries, error) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return indexSegment(data).read(bytes.NewReader(data), include, from, to)
+}
+
+// Return the index of the specified segment, which ends at the first truncated or corrupt record
+func indexSegment(data []byte) *segmentIndex {
+
+	index := &segmentIndex{series: make(map[uint64]*storedSeries)}
+	if !bytes.HasPrefix(data, []byte(segmentMagic)) {
+		return index
+	}
+
+	pos := len(segmentMagic)
+	for pos < len(data) {
+		payload, next := nextRecord(data, pos)
+		if payload == nil {
+			break
+		}
+		switch payload[0] {
+		case recordSeries:
+			decoder := &recordDecoder{data: payload[1:]}
+			id := decoder.uvarint()
+			s := &storedSeries{metricName: decoder.string(), labels: make(map[string]string)}
+			for n := decoder.uvarint(); n > 0 && decoder.ok(); n-- {
+				name := decoder.string()
+				s.labels[name] = decoder.string()
+			}
+			if decoder.ok() {
+				index.series[id] = s
+			}
+		case recordBatch, recordSamples:
+			record := indexedRecord{start: int64(pos), end: int64(next), batch: payload[0] == recordBatch, minTime: math.MaxInt64, maxTime: math.MinInt64}
+			decodeSamples(payload, func(id uint64, s sample) {
+				record.id = id
+				record.addTime(s.time)
+			})
+			if record.minTime <= record.maxTime {
+				index.records = append(index.records, record)
+			}
+		}
+		pos = next
+	}
+	index.length = int64(pos)
+	return index
+}
+
+// Extend the range of times of the samples in the record to include the specified time
+func (record *indexedRecord) addTime(t int64) {
+	if t < record.minTime {
+		record.minTime = t
+	}
+	if t > record.maxTime {
+		record.maxTime = t
+	}
+}
+
+// Return a copy of the index that is not changed by subsequent writes to the segment
+// The caller must prevent the index being changed while it is copied
+func (index *segmentIndex) snapshot() *segmentIndex {
+	series := make(map[uint64]*storedSeries, len(index.series))
+	for id, s := range index.series {
+		series[id] = s
+	}
+	records := index.records[:len(index.records):len(index.records)]
+	return &segmentIndex{series: series, records: records, length: index.length}
+}
+
+// Read the indexed segment from the specified reader, returning the series whose metric name and labels are accepted by include,
+// keyed by id, with their samples whose time is after from and not after to
+// Only the records that may contain such samples are read, and adjacent records are read together
+func (index *segmentIndex) read(reader io.ReaderAt, include func(metricName string, labels map[string]string) bool, from int64, to int64) (map[uint64]*storedSeries, error) {
+
+	series := make(map[uint64]*storedSeries)
+	for id, s := range index.series {
+		if include(s.metricName, s.labels) {
+			series[id] = &storedSeries{metricName: s.metricName, labels: s.labels}
+		}
+	}
+	needed := func(record indexedRecord) bool {
+		return record.maxTime > from && record.minTime <= to && (record.batch || series[record.id] != nil)
+	}
+	addSample := func(id uint64, s sample) {
+		if selected, ok := series[id]; ok && s.time > from && s.time <= to {
+			selected.samples = append(selected.samples, s)
+		}
+	}
+
+	var data []byte
+	records := index.records
+	for i := 0; i < len(records) && len(series) > 0; {
+		if !needed(records[i]) {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(records) && needed(records[j]) && records[j].start == records[j-1].end {
+			j++
+		}
+		start, end := records[i].start, records[j-1].end
+		if int64(cap(data)) < end-start {
+			data = make([]byte, end-start)
+		}
+		data = data[:end-start]
+		if n, err := reader.ReadAt(data, start); n < len(data) {
+			return nil, errors.New("Unable to read statistics file: " + err.Error())
+		}
+		for pos := 0; pos < len(data); {
+			payload, next := nextRecord(data, pos)
+			if payload == nil {
+				return nil, errors.New("Unable to read statistics file: the record at " + strconv.FormatInt(start+int64(pos), 10) + " is corrupt")
+			}
+			decodeSamples(payload, addSample)
+			pos = next
+		}
+		i = j
+	}
+	return series, nil
+}
+
+// Call add for each sample in the specified payload of a recordBatch or recordSamples
+func decodeSamples(payload []byte, add func(id uint64, s sample)) {
+	decoder := &recordDecoder{data: payload[1:]}
+	switch payload[0] {
+	case recordBatch:
+		for n := decoder.uvarint(); n > 0 && decoder.ok(); n-- {
+			id := decoder.uvarint()
+			s := decoder.sample()
+			if decoder.ok() {
+				add(id, s)
+			}
+		}
+	case recordSamples:
+		id := decoder.uvarint()
+		for n := decoder.uvarint(); n > 0 && decoder.ok(); n-- {
+			s := decoder.sample()
+			if decoder.ok() {
+				add(id, s)
+			}
+		}
+	}
+}
+
+// Return the payload of the record at the specified position and the position of the next record,
+// or a nil payload if the record is truncated or corrupt
+func nextRecord(data []byte, pos int) ([]byte, int) {
+	length, n := binary.Uvarint(data[pos:])
+	if n <= 0 || length == 0 || uint64(len(data)-pos-n) < length+4 {
+		return nil, pos
+	}
+	start := pos + n
+	end := start + int(length)
+	payload := data[start:end]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[end:end+4]) {
+		return nil, pos
+	}
+	return payload, end + 4
+}
+
+// Add the samples of the specified series to merged, keyed by seriesKey, ignoring samples that are not later than
+// the latest sample of the series already in merged
+func mergeSeries(merged map[string]*storedSeries, series map[uint64]*storedSeries) {
+	for _, s := range series {
+		if len(s.samples) == 0 {
+			continue
+		}
+		key := seriesKey(s.metricName, s.labels)
+		existing, ok := merged[key]
+		if !ok {
+			existing = &storedSeries{metricName: s.metricName, labels: s.labels}
+			merged[key] = existing
+		}
+		for _, smp := range s.samples {
+			if len(existing.samples) == 0 || smp.time > existing.samples[len(existing.samples)-1].time {
+				existing.samples = append(existing.samples, smp)
+			}
+		}
+	}
+}
+
+// Return the payload of a record that defines a series
+func seriesRecord(id uint64, metricName string, labels map[string]string) []byte {
+	payload := appendUvarint([]byte{recordSeries}, id)
+	payload = appendString(payload, metricName)
+	payload = appendUvarint(payload, uint64(len(labels)))
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		payload = appendString(payload, name)
+		payload = appendString(payload, labels[name])
+	}
+	return payload
+}
+
+// Return the payload of a record that contains samples of a single series
+func samplesRecord(id uint64, samples sampleList) []byte {
+	payload := appendUvarint([]byte{recordSamples}, id)
+	payload = appendUvarint(payload, uint64(len(samples)))
+	for _, s := range samples {
+		payload = appendSample(payload, s)
+	}
+	return payload
+}
+
+// Append a record with the specified payload, preceded by its length and followed by its checksum
+func appendRecord(data []byte, payload []byte) []byte {
+	data = appendUvarint(data, uint64(len(payload)))
+	data = append(data, payload...)
+	return appendUint32(data, crc32.ChecksumIEEE(payload))
+}
+
+func appendString(data []byte, s string) []byte {
+	data = appendUvarint(data, uint64(len(s)))
+	return append(data, s...)
+}
+
+func appendSample(data []byte, s sample) []byte {
+	data = appendVarint(data, s.time)
+	return appendUint64(data, math.Float64bits(s.value))
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(data []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+func appendUint64(data []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+// Decodes the fields of a record payload, remembering whether any field could not be decoded
+type recordDecoder struct {
+	data   []byte
+	failed bool
+}
+
+func (decoder *recordDecoder) ok() bool {
+	return !decoder.failed
+}
+
+func (decoder *recordDecoder) uvarint() uint64 {
+	value, n := binary.Uvarint(decoder.data)
+	if n <= 0 {
+		decoder.failed = true
+		return 0
+	}
+	decoder.data = decoder.data[n:]
+	return value
+}
+
+func (decoder *recordDecoder) string() string {
+	length := decoder.uvarint()
+	if decoder.failed || uint64(len(decoder.data)) < length {
+		decoder.failed = true
+		return ""
+	}
+	s := string(decoder.data[:length])
+	decoder.data = decoder.data[length:]
+	return s
+}
+
+func (decoder *recordDecoder) sample() sample {
+	t, n := binary.Varint(decoder.data)
+	if n <= 0 || len(decoder.data) < n+8 {
+		decoder.failed = true
+		return sample{}
+	}
+	value := math.Float64frombits(binary.BigEndian.Uint64(decoder.data[n : n+8]))
+	decoder.data = decoder.data[n+8:]
+	return sample{time: t, value: value}
+}
+
+// Write the specified data to a new file and wait until it is on disk
+func writeFileSync(filename string, data []byte) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Return the specified time, in milliseconds since the epoch, rounded down to a multiple of the specified duration
+func floorMillis(t int64, d time.Duration) int64 {
+	millis := int64(d / time.Millisecond)
+	floor := t - t%millis
+	if t < 0 && t%millis != 0 {
+		floor -= millis
+	}
+	return floor
+}
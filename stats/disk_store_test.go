@@ -0,0 +1,212 @@
+package stats
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Return a new diskStore in a temporary directory, and a function that removes the directory
+func newTestDiskStore(t *testing.T, retention time.Duration) (*diskStore, func()) {
+	dir, err := ioutil.TempDir("", "fnstats")
+	assertNoError(t, "creating temporary directory", err)
+	store, err := openDiskStore(dir, retention)
+	assertNoError(t, "opening store", err)
+	return store, func() { os.RemoveAll(dir) }
+}
+
+// Return a sample of fn_calls in myapp at the specified time
+func testCallsSample(route string, time int64, value float64) storedSample {
+	return storedSample{metricName: "fn_calls", labels: map[string]string{appLabel: "myapp", routeLabel: route}, sample: sample{time: time, value: value}}
+}
+
+func TestDiskStoreAppendAndRead(t *testing.T) {
+
+	store, remove := newTestDiskStore(t, defaultEmbeddedRetention)
+	defer remove()
+
+	// two hours of samples every 15 minutes, which are written to two segments
+	start := int64(1500000000000) / int64(time.Hour/time.Millisecond) * int64(time.Hour/time.Millisecond)
+	step := int64(15 * time.Minute / time.Millisecond)
+	for i := int64(0); i < 8; i++ {
+		now := start + i*step
+		assertNoError(t, "appending samples", store.append(now, []storedSample{testCallsSample("/hello", now, float64(i)), testCallsSample("/goodbye", now, float64(i*2))}))
+	}
+	segments, err := store.segments()
+	assertNoError(t, "listing segments", err)
+	assertIntsEqual(t, "Number of segments", 2, len(segments))
+
+	data, err := store.read([]string{"fn_calls"}, &queryScope{appName: "myapp", routeName: "/hello"}, start+step, start+5*step)
+	assertNoError(t, "reading samples", err)
+	assertIntsEqual(t, "Number of series", 1, len(data["fn_calls"]))
+	samples := data["fn_calls"][0].samples
+	assertIntsEqual(t, "Number of samples", 4, len(samples))
+	assertFloatsEqual(t, "First sample", 2, samples[0].value)
+	assertFloatsEqual(t, "Last sample", 5, samples[3].value)
+
+	data, err = store.read([]string{"fn_errors"}, &queryScope{}, start, start+8*step)
+	assertNoError(t, "reading samples of another metric", err)
+	assertIntsEqual(t, "Number of fn_errors series", 0, len(data["fn_errors"]))
+}
+
+func TestDiskStoreCorruptTail(t *testing.T) {
+
+	store, remove := newTestDiskStore(t, defaultEmbeddedRetention)
+	defer remove()
+
+	start := int64(1500000000000)
+	assertNoError(t, "appending samples", store.append(start, []storedSample{testCallsSample("/hello", start, 1)}))
+	store.active.file.Close()
+
+	// simulate a record that was only partly written when the Fn server stopped
+	segments, err := store.segments()
+	assertNoError(t, "listing segments", err)
+	file, err := os.OpenFile(segments[0].filename, os.O_WRONLY|os.O_APPEND, 0644)
+	assertNoError(t, "opening segment", err)
+	_, err = file.Write([]byte{40, recordBatch, 1, 2})
+	assertNoError(t, "writing to segment", err)
+	file.Close()
+
+	store, err = openDiskStore(store.dir, defaultEmbeddedRetention)
+	assertNoError(t, "reopening store", err)
+	assertNoError(t, "appending samples after reopening", store.append(start+1000, []storedSample{testCallsSample("/hello", start+1000, 2)}))
+
+	data, err := store.read(nil, &queryScope{}, 0, start+1000)
+	assertNoError(t, "reading samples", err)
+	assertIntsEqual(t, "Number of series", 1, len(data["fn_calls"]))
+	assertIntsEqual(t, "Number of samples", 2, len(data["fn_calls"][0].samples))
+	assertFloatsEqual(t, "Sample appended after reopening", 2, data["fn_calls"][0].samples[1].value)
+}
+
+func TestDiskStoreReadsOnlyNeededRecords(t *testing.T) {
+
+	store, remove := newTestDiskStore(t, defaultEmbeddedRetention)
+	defer remove()
+
+	// four samples in the first segment, and one in the second so that the first is no longer active
+	start := int64(1500000000000) / int64(time.Hour/time.Millisecond) * int64(time.Hour/time.Millisecond)
+	step := int64(15 * time.Minute / time.Millisecond)
+	for i := int64(0); i < 5; i++ {
+		now := start + i*step
+		assertNoError(t, "appending samples", store.append(now, []storedSample{testCallsSample("/hello", now, float64(i))}))
+	}
+	_, err := store.read(nil, &queryScope{}, 0, start+5*step)
+	assertNoError(t, "reading samples", err)
+	segments, err := store.segments()
+	assertNoError(t, "listing segments", err)
+	index := store.indexes[segments[0].filename]
+	if index == nil {
+		t.Fatalf("Expected the index of %s to be cached", segments[0].filename)
+	}
+
+	// corrupt the record containing the first sample without changing the file, as far as the cached index can tell
+	info, err := os.Stat(segments[0].filename)
+	assertNoError(t, "getting segment information", err)
+	file, err := os.OpenFile(segments[0].filename, os.O_WRONLY, 0644)
+	assertNoError(t, "opening segment", err)
+	_, err = file.WriteAt([]byte{0xff}, index.index.records[0].end-1)
+	assertNoError(t, "writing to segment", err)
+	file.Close()
+	assertNoError(t, "resetting modification time", os.Chtimes(segments[0].filename, info.ModTime(), info.ModTime()))
+
+	// only the records containing samples in the requested period are read
+	data, err := store.read(nil, &queryScope{}, start, start+5*step)
+	assertNoError(t, "reading samples after the first", err)
+	assertIntsEqual(t, "Number of samples", 4, len(data["fn_calls"][0].samples))
+	if _, err = store.read(nil, &queryScope{}, 0, start+5*step); err == nil {
+		t.Errorf("Expected an error when reading the corrupt record")
+	}
+}
+
+func TestSegmentWriterFailedWrite(t *testing.T) {
+
+	store, remove := newTestDiskStore(t, defaultEmbeddedRetention)
+	defer remove()
+
+	start := int64(1500000000000)
+	writer, err := openSegmentWriter(store.segmentFile(start, start+int64(segmentDuration/time.Millisecond)))
+	assertNoError(t, "opening segment", err)
+
+	// a series is not defined by a write that fails, so it is defined by the next write
+	writer.file.Close()
+	if err := writer.write([]storedSample{testCallsSample("/hello", start, 1)}); err == nil {
+		t.Fatalf("Expected an error when writing to a closed file")
+	}
+	assertIntsEqual(t, "Number of series after failed write", 0, len(writer.ids))
+	assertIntsEqual(t, "Number of indexed series after failed write", 0, len(writer.index.series))
+
+	writer.file, err = os.OpenFile(writer.segment.filename, os.O_RDWR, 0644)
+	assertNoError(t, "reopening segment", err)
+	defer writer.file.Close()
+	_, err = writer.file.Seek(writer.index.length, io.SeekStart)
+	assertNoError(t, "seeking to the end of the segment", err)
+	assertNoError(t, "writing samples", writer.write([]storedSample{testCallsSample("/hello", start+1000, 2)}))
+	series, err := readSegment(writer.segment.filename, func(string, map[string]string) bool { return true }, 0, start+1000)
+	assertNoError(t, "reading segment", err)
+	assertIntsEqual(t, "Number of series", 1, len(series))
+	for _, s := range series {
+		assertStringsEqual(t, "Metric name", "fn_calls", s.metricName)
+		assertIntsEqual(t, "Number of samples", 1, len(s.samples))
+	}
+}
+
+func TestDiskStoreCompactionAndRetention(t *testing.T) {
+
+	store, remove := newTestDiskStore(t, 2*compactionDuration)
+	defer remove()
+
+	// four days of samples every six hours
+	day := int64(compactionDuration / time.Millisecond)
+	start := int64(1500000000000) / day * day
+	step := day / 4
+	for i := int64(0); i < 16; i++ {
+		now := start + i*step
+		assertNoError(t, "appending samples", store.append(now, []storedSample{testCallsSample("/hello", now, float64(i))}))
+	}
+
+	// the first day has expired, the second and third days are compacted, and the fourth day is not yet compacted
+	segments, err := store.segments()
+	assertNoError(t, "listing segments", err)
+	assertIntsEqual(t, "Number of segments", 6, len(segments))
+	assertStringsEqual(t, "First segment", filepath.Join(store.dir, "1500076800000-1500163200000.seg"), segments[0].filename)
+	assertStringsEqual(t, "Second segment", filepath.Join(store.dir, "1500163200000-1500249600000.seg"), segments[1].filename)
+
+	data, err := store.read(nil, &queryScope{}, 0, start+16*step)
+	assertNoError(t, "reading samples", err)
+	samples := data["fn_calls"][0].samples
+	assertIntsEqual(t, "Number of samples", 12, len(samples))
+	assertFloatsEqual(t, "First sample", 4, samples[0].value)
+	assertFloatsEqual(t, "Last sample", 15, samples[11].value)
+}
+
+func TestEmbeddedBackendWithDiskStore(t *testing.T) {
+
+	store, remove := newTestDiskStore(t, defaultEmbeddedRetention)
+	defer remove()
+
+	start := time.Unix(1500000000, 0)
+	backend := newTestEmbeddedBackend(start, store)
+
+	// a backend that holds only two samples of each series in memory, as if the Fn server had been restarted,
+	// reads older samples from disk
+	restarted := newEmbeddedBackend(backend.gatherer, 2, store)
+	assertNoError(t, "loading samples", restarted.load(start))
+	assertIntsEqual(t, "Number of gather times", 2, restarted.gatherTimes.count)
+
+	scope := &queryScope{appName: "myapp", routeName: "/hello", window: time.Minute, step: 15 * time.Second}
+	result, err := restarted.QueryCurrent(context.Background(), &statisticQuery{statistic: builtinStatistics[callsConst], scope: scope, endTime: start.Add(time.Minute)})
+	assertNoError(t, "querying calls", err)
+	if result.value == nil {
+		t.Fatalf("Expected a value for calls")
+	}
+	assertFloatsEqual(t, "calls", 5, *result.value)
+
+	history, err := restarted.QueryRange(context.Background(), &statisticQuery{statistic: builtinStatistics[callsConst], mode: modeCumulative, scope: scope, startTime: start.Add(-time.Hour), endTime: start.Add(time.Minute)})
+	assertNoError(t, "querying calls from disk", err)
+	assertIntsEqual(t, "Number of calls values", 5, len(history.values))
+	assertFloatsEqual(t, "First value of calls", 1, history.values[0].Value)
+}
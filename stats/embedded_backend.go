@@ -0,0 +1,353 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// In embedded mode the statistics APIs do not use an external Prometheus server
+// Instead the Prometheus metrics registered in the Fn server (the same metrics that it exposes on /metrics)
+// are gathered every scrape interval and the most recent samples of each series are held in memory
+// Queries are evaluated against these samples in the same way as the equivalent Prometheus query (see embedded_query.go)
+// Optionally, every sample is also written to disk (see disk_store.go), so that samples older than those held in memory
+// can be queried, and the samples held in memory are restored when the Fn server is restarted
+
+// the default number of samples held for each series, which is an hour at the default scrape interval
+const defaultEmbeddedPoints = 240
+
+// the maximum age of the sample used as the value of a series at a particular time, which is the same as Prometheus
+const embeddedLookback = 5 * time.Minute
+
+// The queryBackend that holds the metrics of this Fn server in memory
+type embeddedBackend struct {
+	gatherer     prometheus.Gatherer
+	points       int        // the number of samples held for each series
+	instanceName string     // the value of the instance label added to each series, since this is not a Prometheus scrape
+	store        *diskStore // optional, where every sample is also written
+	mutex        sync.RWMutex
+	series       map[string]map[string]*embeddedSeries // protected by mutex, keyed by metric name and then by seriesKey
+	gatherTimes  *sampleRing                           // protected by mutex, the times at which the samples held in memory were gathered
+}
+
+// A single time series, such as fn_calls{fn_appname="myapp",fn_path="/hello"}
+type embeddedSeries struct {
+	metricName string
+	labels     map[string]string
+	samples    *sampleRing
+}
+
+// A single sample of a series
+type sample struct {
+	time  int64 // in milliseconds since the epoch
+	value float64
+}
+
+// A ring buffer holding the most recent samples of a series, in time order
+type sampleRing struct {
+	samples []sample
+	start   int // the index of the oldest sample
+	count   int
+}
+
+// Create an embedded backend that gathers metrics from the specified gatherer, holding the specified number of samples of each series
+// in memory, and also writing them to the specified store if it is not nil
+func newEmbeddedBackend(gatherer prometheus.Gatherer, points int, store *diskStore) *embeddedBackend {
+	instanceName, err := os.Hostname()
+	if err != nil {
+		instanceName = "localhost"
+	}
+	return &embeddedBackend{
+		gatherer:     gatherer,
+		points:       points,
+		instanceName: instanceName,
+		store:        store,
+		series:       make(map[string]map[string]*embeddedSeries),
+		gatherTimes:  newSampleRing(points),
+	}
+}
+
+// Gather metrics every interval, forever
+// If samples cannot be written to disk they are still held in memory, so the error is logged and gathering continues
+func (backend *embeddedBackend) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := backend.gather(time.Now()); err != nil {
+			log.Println("Unable to store statistics: " + err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+// Gather the current value of every metric and add it to the samples of its series, using the specified time
+// Gathering errors are ignored, since the gatherer still returns every metric that could be gathered,
+// but an error is returned if the samples cannot be written to disk
+func (backend *embeddedBackend) gather(now time.Time) error {
+
+	metricFamilies, _ := backend.gatherer.Gather()
+
+	backend.mutex.Lock()
+	nowMillis := toMillis(now)
+	var samples []storedSample
+	for _, metricFamily := range metricFamilies {
+		for _, metric := range metricFamily.GetMetric() {
+			labels := map[string]string{instanceLabel: backend.instanceName}
+			for _, labelPair := range metric.GetLabel() {
+				labels[labelPair.GetName()] = labelPair.GetValue()
+			}
+			sampleTime := nowMillis
+			if metric.TimestampMs != nil {
+				sampleTime = metric.GetTimestampMs()
+			}
+			samples = backend.addSamples(samples, metricFamily.GetName(), metricFamily.GetType(), metric, labels, sampleTime)
+		}
+	}
+	backend.gatherTimes.add(sample{time: nowMillis})
+	backend.mutex.Unlock()
+
+	if backend.store == nil {
+		return nil
+	}
+	return backend.store.append(nowMillis, samples)
+}
+
+// Restore the samples held in memory from the store, which holds the samples gathered before the Fn server was restarted
+// Samples gathered since the specified time are restored, up to the number held for each series
+func (backend *embeddedBackend) load(from time.Time) error {
+
+	data, err := backend.store.read(nil, &queryScope{}, toMillis(from), math.MaxInt64)
+	if err != nil {
+		return err
+	}
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	gatherTimes := make(map[int64]bool)
+	for metricName, series := range data {
+		for _, s := range series {
+			for _, smp := range s.samples {
+				backend.addSample(metricName, s.labels, smp)
+				gatherTimes[smp.time] = true
+			}
+		}
+	}
+	times := make([]int64, 0, len(gatherTimes))
+	for t := range gatherTimes {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	for _, t := range times {
+		backend.gatherTimes.add(sample{time: t})
+	}
+	return nil
+}
+
+// Add the samples of a single metric, which are split into several series in the same way as in the Prometheus exposition format,
+// so that a histogram with the name fn_durations becomes fn_durations_bucket, fn_durations_sum and fn_durations_count
+// Returns the specified stored samples with the added samples appended, so that they can be written to disk
+// The caller must hold the write lock
+func (backend *embeddedBackend) addSamples(samples []storedSample, name string, metricType dto.MetricType, metric *dto.Metric, labels map[string]string, sampleTime int64) []storedSample {
+	add := func(metricName string, labels map[string]string, value float64) {
+		s := sample{time: sampleTime, value: value}
+		backend.addSample(metricName, labels, s)
+		samples = append(samples, storedSample{metricName: metricName, labels: labels, sample: s})
+	}
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		add(name, labels, metric.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		add(name, labels, metric.GetGauge().GetValue())
+	case dto.MetricType_UNTYPED:
+		add(name, labels, metric.GetUntyped().GetValue())
+	case dto.MetricType_SUMMARY:
+		summary := metric.GetSummary()
+		for _, quantile := range summary.GetQuantile() {
+			add(name, withLabel(labels, "quantile", formatFloat(quantile.GetQuantile())), quantile.GetValue())
+		}
+		add(name+"_sum", labels, summary.GetSampleSum())
+		add(name+"_count", labels, float64(summary.GetSampleCount()))
+	case dto.MetricType_HISTOGRAM:
+		histogram := metric.GetHistogram()
+		hasInfBucket := false
+		for _, bucket := range histogram.GetBucket() {
+			hasInfBucket = hasInfBucket || math.IsInf(bucket.GetUpperBound(), 1)
+			add(name+"_bucket", withLabel(labels, "le", formatFloat(bucket.GetUpperBound())), float64(bucket.GetCumulativeCount()))
+		}
+		if !hasInfBucket {
+			add(name+"_bucket", withLabel(labels, "le", "+Inf"), float64(histogram.GetSampleCount()))
+		}
+		add(name+"_sum", labels, histogram.GetSampleSum())
+		add(name+"_count", labels, float64(histogram.GetSampleCount()))
+	}
+	return samples
+}
+
+// Add a sample to the series with the specified metric name and labels, creating the series if necessary
+// The caller must hold the write lock
+func (backend *embeddedBackend) addSample(metricName string, labels map[string]string, s sample) {
+	seriesByKey, ok := backend.series[metricName]
+	if !ok {
+		seriesByKey = make(map[string]*embeddedSeries)
+		backend.series[metricName] = seriesByKey
+	}
+	key := seriesKey(metricName, labels)
+	series, ok := seriesByKey[key]
+	if !ok {
+		series = &embeddedSeries{metricName: metricName, labels: labels, samples: newSampleRing(backend.points)}
+		seriesByKey[key] = series
+	}
+	series.samples.add(s)
+}
+
+// Return the values of the statistic at each step between the start and end of the query
+func (backend *embeddedBackend) QueryRange(ctx context.Context, query *statisticQuery) (*rangeResult, error) {
+
+	data, err := backend.queryData(query)
+	if err != nil {
+		return nil, err
+	}
+
+	groupedValues := make(map[string][]metricsTimeValuePair)
+	step := query.scope.step
+	if step <= 0 {
+		step = scrapeInterval
+	}
+	for t := query.startTime; !t.After(query.endTime); t = t.Add(step) {
+		for labelValue, value := range evaluate(query, data, t) {
+			groupedValues[labelValue] = append(groupedValues[labelValue], metricsTimeValuePair{Time: t.Unix(), Value: value})
+		}
+	}
+
+	if query.scope.groupByLabel != "" {
+		return &rangeResult{groupedValues: groupedValues}, nil
+	}
+	values := groupedValues[""]
+	if values == nil {
+		values = make([]metricsTimeValuePair, 0)
+	}
+	return &rangeResult{values: values}, nil
+}
+
+// Return the value of the statistic at the end of the query, or nil if there is none
+func (backend *embeddedBackend) QueryCurrent(ctx context.Context, query *statisticQuery) (*currentResult, error) {
+
+	data, err := backend.queryData(query)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := evaluate(query, data, query.endTime)[""]; ok {
+		return &currentResult{value: &value}, nil
+	}
+	return &currentResult{}, nil
+}
+
+// Top statistics are not supported, because routes can only be ranked by Prometheus
+func (backend *embeddedBackend) QueryTop(ctx context.Context, query *topQuery) (*topResult, error) {
+	return nil, errors.New("top statistics are only supported when statistics are obtained from Prometheus")
+}
+
+// Return the samples needed to evaluate the query, keyed by metric name
+// These are read from disk if the query needs samples older than those held in memory
+func (backend *embeddedBackend) queryData(query *statisticQuery) (map[string][]seriesSamples, error) {
+
+	from, to := query.embeddedStartTime(), toMillis(query.endTime)
+	backend.mutex.RLock()
+	if backend.store != nil && (backend.gatherTimes.count == 0 || backend.gatherTimes.at(0).time > from) {
+		backend.mutex.RUnlock()
+		return backend.store.read(query.embeddedMetricNames(), query.scope, from, to)
+	}
+	defer backend.mutex.RUnlock()
+
+	data := make(map[string][]seriesSamples)
+	for _, metricName := range query.embeddedMetricNames() {
+		for _, series := range backend.series[metricName] {
+			if query.scope.matches(series.labels) {
+				data[metricName] = append(data[metricName], seriesSamples{labels: series.labels, samples: series.samples.between(from, to)})
+			}
+		}
+	}
+	return data, nil
+}
+
+// Return whether the specified labels match the application, route and instance of the scope
+func (scope *queryScope) matches(labels map[string]string) bool {
+	return (scope.appName == "" || labels[appLabel] == scope.appName) &&
+		(scope.routeName == "" || labels[routeLabel] == scope.routeName) &&
+		(scope.instanceName == "" || labels[instanceLabel] == scope.instanceName)
+}
+
+// Return a string that uniquely identifies the series with the specified metric name and labels
+func seriesKey(metricName string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := metricName
+	for _, name := range names {
+		key += "," + name + "=" + strconv.Quote(labels[name])
+	}
+	return key
+}
+
+// Return a copy of the specified labels with an additional label
+func withLabel(labels map[string]string, name string, value string) map[string]string {
+	copied := make(map[string]string, len(labels)+1)
+	for labelName, labelValue := range labels {
+		copied[labelName] = labelValue
+	}
+	copied[name] = value
+	return copied
+}
+
+// Format a float in the same way as in the Prometheus exposition format, such as 0.5 or +Inf
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func newSampleRing(capacity int) *sampleRing {
+	return &sampleRing{samples: make([]sample, capacity)}
+}
+
+// Add a sample, replacing the oldest sample if the ring is full
+// A sample that is not later than the newest sample is ignored
+func (ring *sampleRing) add(s sample) {
+	if ring.count > 0 && s.time <= ring.at(ring.count-1).time {
+		return
+	}
+	if ring.count < len(ring.samples) {
+		ring.samples[(ring.start+ring.count)%len(ring.samples)] = s
+		ring.count++
+		return
+	}
+	ring.samples[ring.start] = s
+	ring.start = (ring.start + 1) % len(ring.samples)
+}
+
+// Return the sample at the specified index, where 0 is the oldest sample
+func (ring *sampleRing) at(i int) sample {
+	return ring.samples[(ring.start+i)%len(ring.samples)]
+}
+
+// Return a copy of the samples whose time is after from and not after to, in time order
+func (ring *sampleRing) between(from int64, to int64) sampleList {
+	var samples sampleList
+	for i := 0; i < ring.count; i++ {
+		if s := ring.at(i); s.time > from && s.time <= to {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
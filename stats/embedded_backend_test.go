@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"testing"
+	"time"
+)
+
+// Return an embedded backend that gathers fn_calls and the durations histogram from a new registry,
+// after making one call to /hello in myapp and two calls to /goodbye every 15 seconds for a minute
+// Samples are also written to the specified store, unless it is nil
+func newTestEmbeddedBackend(start time.Time, store *diskStore) *embeddedBackend {
+
+	promRegistry := prometheus.NewRegistry()
+	calls := prometheus.NewCounterVec(prometheus.CounterOpts{Name: promMetricNames[callsConst]}, []string{appLabel, routeLabel})
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: promMetricNames[durationsConst], Buckets: []float64{0.1, 1, 10}}, []string{appLabel, routeLabel})
+	promRegistry.MustRegister(calls, durations)
+
+	backend := newEmbeddedBackend(promRegistry, 10, store)
+	for i := 0; i <= 4; i++ {
+		calls.WithLabelValues("myapp", "/hello").Inc()
+		durations.WithLabelValues("myapp", "/hello").Observe(0.5)
+		calls.WithLabelValues("myapp", "/goodbye").Add(2)
+		durations.WithLabelValues("myapp", "/goodbye").Observe(5)
+		durations.WithLabelValues("myapp", "/goodbye").Observe(5)
+		backend.gather(start.Add(time.Duration(i) * 15 * time.Second))
+	}
+	return backend
+}
+
+func TestEmbeddedBackendQueryRange(t *testing.T) {
+
+	start := time.Unix(1500000000, 0)
+	backend := newTestEmbeddedBackend(start, nil)
+	scope := &queryScope{appName: "myapp", window: time.Minute, step: 15 * time.Second}
+	calls := builtinStatistics[callsConst]
+
+	result, err := backend.QueryRange(context.Background(), &statisticQuery{statistic: calls, mode: modeCumulative, scope: scope, startTime: start, endTime: start.Add(time.Minute)})
+	assertNoError(t, "querying calls", err)
+	assertIntsEqual(t, "Number of calls values", 5, len(result.values))
+	assertFloatsEqual(t, "Last value of calls", 15, result.values[4].Value)
+
+	result, err = backend.QueryRange(context.Background(), &statisticQuery{statistic: calls, mode: modeRate, scope: scope, startTime: start, endTime: start.Add(time.Minute)})
+	assertNoError(t, "querying rate of calls", err)
+	// there are too few samples to calculate a rate at the start
+	assertIntsEqual(t, "Number of rate of calls values", 4, len(result.values))
+	assertFloatsEqual(t, "Rate of calls", 0.2, result.values[3].Value)
+
+	durations := builtinStatistics[durationsConst]
+	result, err = backend.QueryRange(context.Background(), &statisticQuery{statistic: durations, scope: scope, startTime: start.Add(time.Minute), endTime: start.Add(time.Minute)})
+	assertNoError(t, "querying durations", err)
+	assertIntsEqual(t, "Number of durations values", 1, len(result.values))
+	assertFloatsEqual(t, "Mean duration", (0.5+5+5)/3, result.values[0].Value)
+
+	groupedScope := &queryScope{appName: "myapp", groupByLabel: routeLabel, window: time.Minute, step: 15 * time.Second}
+	quantile := 0.5
+	result, err = backend.QueryRange(context.Background(), &statisticQuery{statistic: durations, quantile: &quantile, scope: groupedScope, startTime: start.Add(time.Minute), endTime: start.Add(time.Minute)})
+	assertNoError(t, "querying median duration of each route", err)
+	assertIntsEqual(t, "Number of routes", 2, len(result.groupedValues))
+	assertFloatsEqual(t, "Median duration of /hello", 0.55, result.groupedValues["/hello"][0].Value)
+	assertFloatsEqual(t, "Median duration of /goodbye", 5.5, result.groupedValues["/goodbye"][0].Value)
+}
+
+func TestEmbeddedBackendQueryCurrent(t *testing.T) {
+
+	start := time.Unix(1500000000, 0)
+	backend := newTestEmbeddedBackend(start, nil)
+	scope := &queryScope{appName: "myapp", routeName: "/hello", window: time.Minute}
+
+	result, err := backend.QueryCurrent(context.Background(), &statisticQuery{statistic: builtinStatistics[callsConst], scope: scope, endTime: start.Add(20 * time.Second)})
+	assertNoError(t, "querying calls", err)
+	if result.value == nil {
+		t.Fatalf("Expected a value for calls")
+	}
+	assertFloatsEqual(t, "calls", 2, *result.value)
+
+	result, err = backend.QueryCurrent(context.Background(), &statisticQuery{statistic: builtinStatistics[callsConst], scope: scope, endTime: start.Add(-time.Second)})
+	assertNoError(t, "querying calls before the first sample", err)
+	if result.value != nil {
+		t.Errorf("Expected no value for calls before the first sample, got %v", *result.value)
+	}
+}
+
+func TestSampleRing(t *testing.T) {
+
+	ring := newSampleRing(3)
+	for i := int64(1); i <= 5; i++ {
+		ring.add(sample{time: i * 1000, value: float64(i)})
+	}
+	// samples that are not later than the newest sample are ignored
+	ring.add(sample{time: 2000, value: 100})
+
+	samples := ring.between(0, 10000)
+	assertIntsEqual(t, "Number of samples", 3, len(samples))
+	assertFloatsEqual(t, "Oldest sample", 3, samples[0].value)
+	assertFloatsEqual(t, "Newest sample", 5, samples[2].value)
+	if s, ok := ring.between(0, 10000).latest(4500); !ok || s.value != 4 {
+		t.Errorf("Expected the latest sample at 4500 to be 4, got %v", s.value)
+	}
+}
+
+func TestBucketQuantile(t *testing.T) {
+
+	buckets := []bucket{{upperBound: 1, count: 10}, {upperBound: 2, count: 20}, {upperBound: math.Inf(1), count: 20}}
+	assertFloatsEqual(t, "median", 1, bucketQuantile(0.5, buckets))
+	assertFloatsEqual(t, "0.75 quantile", 1.5, bucketQuantile(0.75, buckets))
+	if !math.IsNaN(bucketQuantile(0.5, []bucket{{upperBound: math.Inf(1), count: 0}})) {
+		t.Errorf("Expected NaN for a histogram with no finite buckets")
+	}
+}
@@ -0,0 +1,271 @@
+package stats
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The evaluation of statistics by embeddedBackend, which calculates the same values as the Prometheus queries
+// built in build_prometheus_request.go, using samples held in memory or on disk
+
+// The samples of a single series that are available to a query, in time order
+type seriesSamples struct {
+	labels  map[string]string
+	samples sampleList
+}
+
+// A list of samples in time order
+type sampleList []sample
+
+// The value of a single series at a particular time
+type seriesValue struct {
+	labels map[string]string
+	value  float64
+}
+
+// Return the names of the metrics needed to evaluate the query
+func (query *statisticQuery) embeddedMetricNames() []string {
+	metricName := query.statistic.Metric
+	switch {
+	case query.quantile != nil:
+		return []string{metricName + "_bucket"}
+	case query.statistic.Query.kind == kindHistogram:
+		return []string{metricName + "_sum", metricName + "_count"}
+	case query.statistic.Query.kind == kindRatio:
+		return []string{metricName, promMetricNames[callsConst]}
+	default:
+		return []string{metricName}
+	}
+}
+
+// Return the earliest time, in milliseconds since the epoch, of the samples needed to evaluate the query
+// at each step of its range
+func (query *statisticQuery) embeddedStartTime() int64 {
+	lookback := embeddedLookback
+	if query.scope.window > lookback {
+		lookback = query.scope.window
+	}
+	if query.scope.step > lookback {
+		lookback = query.scope.step
+	}
+	return toMillis(query.startTime.Add(-lookback))
+}
+
+// Evaluate the statistic at the specified time using the specified samples, which are keyed by metric name,
+// returning its value for each value of the groupByLabel of the scope
+// (or a single value keyed by an empty string if the query is not grouped)
+// Values that are not finite, such as the mean of a histogram with no observations, are omitted
+func evaluate(query *statisticQuery, data map[string][]seriesSamples, t time.Time) map[string]float64 {
+
+	scope := query.scope
+	metricName := query.statistic.Metric
+	at := toMillis(t)
+
+	var values map[string]float64
+	switch {
+	case query.quantile != nil:
+		values = histogramQuantile(*query.quantile, rates(data[metricName+"_bucket"], at, scope.window, false), scope.groupByLabel)
+	case query.statistic.Query.isCounter() && query.mode == modeRate:
+		values = aggregateValues(aggregationSum, rates(data[metricName], at, scope.window, false), scope.groupByLabel)
+	case query.statistic.Query.isCounter() && query.mode == modeIncrease:
+		values = aggregateValues(aggregationSum, rates(data[metricName], at, scope.step, true), scope.groupByLabel)
+	case query.statistic.Query.kind == kindGauge:
+		values = aggregateValues(query.statistic.Query.aggregation, instantValues(data[metricName], at), scope.groupByLabel)
+	case query.statistic.Query.kind == kindHistogram:
+		numerator := aggregateValues(aggregationSum, rates(data[metricName+"_sum"], at, scope.window, false), scope.groupByLabel)
+		denominator := aggregateValues(aggregationSum, rates(data[metricName+"_count"], at, scope.window, false), scope.groupByLabel)
+		values = divide(numerator, denominator)
+	case query.statistic.Query.kind == kindRatio:
+		numerator := aggregateValues(aggregationSum, rates(data[metricName], at, scope.window, false), scope.groupByLabel)
+		denominator := aggregateValues(aggregationSum, rates(data[promMetricNames[callsConst]], at, scope.window, false), scope.groupByLabel)
+		values = divide(numerator, denominator)
+	default:
+		values = aggregateValues(aggregationSum, instantValues(data[metricName], at), scope.groupByLabel)
+	}
+
+	for labelValue, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			delete(values, labelValue)
+		}
+	}
+	return values
+}
+
+// Return the value of each of the specified series at the specified time, which is its latest sample,
+// in the same way as a Prometheus instant vector selector
+func instantValues(series []seriesSamples, at int64) []seriesValue {
+	var values []seriesValue
+	for _, s := range series {
+		if latest, ok := s.samples.latest(at); ok {
+			values = append(values, seriesValue{labels: s.labels, value: latest.value})
+		}
+	}
+	return values
+}
+
+// Return the per-second rate of increase of each of the specified counter series over the specified window,
+// ending at the specified time, in the same way as the Prometheus rate function
+// If increase is true, return the increase over the window instead, in the same way as the Prometheus increase function
+// A decrease in value is assumed to be a counter reset, and a series with fewer than two samples in the window has no value
+func rates(series []seriesSamples, at int64, window time.Duration, increase bool) []seriesValue {
+	var values []seriesValue
+	for _, s := range series {
+		samples := s.samples.between(at-int64(window/time.Millisecond), at)
+		if len(samples) < 2 {
+			continue
+		}
+		var delta float64
+		for i := 1; i < len(samples); i++ {
+			if samples[i].value >= samples[i-1].value {
+				delta += samples[i].value - samples[i-1].value
+			} else {
+				delta += samples[i].value
+			}
+		}
+		// the rate is calculated from the first and last samples, and the increase is extrapolated to the whole window
+		rate := delta / (float64(samples[len(samples)-1].time-samples[0].time) / 1000)
+		if increase {
+			rate *= window.Seconds()
+		}
+		values = append(values, seriesValue{labels: s.labels, value: rate})
+	}
+	return values
+}
+
+// Return the samples whose time is after from and not after to
+func (samples sampleList) between(from int64, to int64) sampleList {
+	first := sort.Search(len(samples), func(i int) bool { return samples[i].time > from })
+	last := sort.Search(len(samples), func(i int) bool { return samples[i].time > to })
+	return samples[first:last]
+}
+
+// Return the latest sample at or before the specified time, which is no older than embeddedLookback, and whether there is one
+func (samples sampleList) latest(at int64) (sample, bool) {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].time > at }) - 1
+	if i < 0 || at-samples[i].time > int64(embeddedLookback/time.Millisecond) {
+		return sample{}, false
+	}
+	return samples[i], true
+}
+
+// Convert a time to milliseconds since the epoch, which is how the time of a sample is held
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Combine the specified values using the specified aggregation (sum, avg, min or max), grouped by the specified label
+// (or into a single group keyed by an empty string if the label is empty), in the same way as a Prometheus aggregation operator
+func aggregateValues(aggregation string, values []seriesValue, groupByLabel string) map[string]float64 {
+	aggregated := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, v := range values {
+		group := v.labels[groupByLabel]
+		current, ok := aggregated[group]
+		switch {
+		case !ok:
+			aggregated[group] = v.value
+		case aggregation == aggregationMin:
+			aggregated[group] = math.Min(current, v.value)
+		case aggregation == aggregationMax:
+			aggregated[group] = math.Max(current, v.value)
+		default:
+			aggregated[group] = current + v.value
+		}
+		counts[group]++
+	}
+	if aggregation == aggregationAvg {
+		for group, count := range counts {
+			aggregated[group] /= float64(count)
+		}
+	}
+	return aggregated
+}
+
+// Divide each value of numerator by the value of denominator with the same key, omitting keys that are not in both
+func divide(numerator map[string]float64, denominator map[string]float64) map[string]float64 {
+	quotients := make(map[string]float64)
+	for key, value := range numerator {
+		if divisor, ok := denominator[key]; ok {
+			quotients[key] = value / divisor
+		}
+	}
+	return quotients
+}
+
+// A single histogram bucket
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// Calculate the specified quantile from the specified values of the buckets of a histogram, grouped by the specified label,
+// in the same way as the Prometheus histogram_quantile function
+func histogramQuantile(quantile float64, bucketValues []seriesValue, groupByLabel string) map[string]float64 {
+
+	// sum the buckets with the same upper bound in each group
+	bucketsByGroup := make(map[string]map[float64]float64)
+	for _, v := range bucketValues {
+		upperBound, err := strconv.ParseFloat(v.labels["le"], 64)
+		if err != nil {
+			continue
+		}
+		group := v.labels[groupByLabel]
+		if bucketsByGroup[group] == nil {
+			bucketsByGroup[group] = make(map[float64]float64)
+		}
+		bucketsByGroup[group][upperBound] += v.value
+	}
+
+	quantiles := make(map[string]float64)
+	for group, countsByUpperBound := range bucketsByGroup {
+		buckets := make([]bucket, 0, len(countsByUpperBound))
+		for upperBound, count := range countsByUpperBound {
+			buckets = append(buckets, bucket{upperBound: upperBound, count: count})
+		}
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+		quantiles[group] = bucketQuantile(quantile, buckets)
+	}
+	return quantiles
+}
+
+// Calculate the specified quantile from the specified buckets, which are sorted by upper bound and have cumulative counts,
+// assuming that observations are distributed evenly within each bucket
+// Returns NaN if there are too few buckets or no observations
+func bucketQuantile(quantile float64, buckets []bucket) float64 {
+
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+	// the counts may not be monotonic if the buckets were sampled at slightly different times
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+	total := buckets[len(buckets)-1].count
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := quantile * total
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	if b == len(buckets)-1 {
+		// the quantile is in the +Inf bucket, so return the highest finite upper bound
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	bucketStart := 0.0
+	bucketEnd := buckets[b].upperBound
+	count := buckets[b].count
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
@@ -1,86 +1,265 @@
 package stats
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
-// Use the specified URL to get a range of data values for a single metric and return it as an array of time-value pairs
-func executePrometheusRequest(url string) ([]metricsTimeValuePair, error) {
+// the maximum time to wait for all the Prometheus requests needed to respond to a single API call
+const prometheusTimeout = 2 * time.Second
 
-	promClient := http.Client{
-		Timeout: time.Second * 2, // Maximum of 2 secs
+// A response from Prometheus
+type prometheusResponse struct {
+	body     []byte
+	server   string   // the base URL of the Prometheus server that sent the response
+	warnings []string // any warnings in the response, which are returned by Thanos if the result may be incomplete
+}
+
+// Use the specified URL to get a range of data values for a single metric and return it as an array of time-value pairs,
+// together with the response from which it was obtained
+func executePrometheusRequest(ctx context.Context, url string) ([]metricsTimeValuePair, *prometheusResponse, error) {
+
+	thisPromQueryRangeData, response, err := getPrometheusQueryRangeData(ctx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(thisPromQueryRangeData.Data.Result) > 1 {
+		// Range query has returned multiple ranges! This should never happen: we must have got the query wrong
+		// Return a suitably verbose error message to allow investigation
+		return nil, nil, errors.New("data array returned by Prometheus has more than one element: url=" + url + ", returned JSON=" + string(response.body[:]))
 	}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if len(thisPromQueryRangeData.Data.Result) == 0 {
+		return make([]metricsTimeValuePair, 0), response, nil
+	}
+	metricDataArray, err := convertTimeValuePairs(thisPromQueryRangeData.Data.Result[0].Value)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return metricDataArray, response, nil
+}
 
-	req.Header.Set("User-Agent", "github.com/fnproject/ext-statsapi")
+// Use the specified URL to get a range of data values for a single metric, grouped by the specified label,
+// and return a map of arrays of time-value pairs, keyed by the value of that label,
+// together with the response from which it was obtained
+func executeGroupedPrometheusRequest(ctx context.Context, url string, groupByLabel string) (map[string][]metricsTimeValuePair, *prometheusResponse, error) {
 
-	res, doErr := promClient.Do(req)
-	if doErr != nil {
-		return nil, doErr
+	thisPromQueryRangeData, response, err := getPrometheusQueryRangeData(ctx, url)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	body, readErr := ioutil.ReadAll(res.Body)
-	if readErr != nil {
-		return nil, readErr
+	metricDataArrays := make(map[string][]metricsTimeValuePair)
+	for _, result := range thisPromQueryRangeData.Data.Result {
+		metricDataArray, err := convertTimeValuePairs(result.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		metricDataArrays[result.Metric[groupByLabel]] = metricDataArray
+	}
+	return metricDataArrays, response, nil
+}
+
+// Send a range query request to the specified URL and return the parsed response and the raw response
+func getPrometheusQueryRangeData(ctx context.Context, url string) (*promQueryRangeData, *prometheusResponse, error) {
+
+	response, err := sendPrometheusRequest(ctx, url)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Assume result is of type "matrix" (meaning this is a range vector)
 
 	thisPromQueryRangeData := promQueryRangeData{}
-	jsonErr := json.Unmarshal(body, &thisPromQueryRangeData)
+	jsonErr := json.Unmarshal(response.body, &thisPromQueryRangeData)
 	if jsonErr != nil {
-		return nil, jsonErr
+		return nil, nil, jsonErr
 	}
 
 	if thisPromQueryRangeData.Status != "success" {
-		return nil, errors.New("Error from Prometheus: " + thisPromQueryRangeData.ErrorType + ": " + thisPromQueryRangeData.Error)
+		return nil, nil, errors.New("Error from Prometheus: " + thisPromQueryRangeData.ErrorType + ": " + thisPromQueryRangeData.Error)
 	}
 
-	if len(thisPromQueryRangeData.Data.Result) > 1 {
-		// Range query has returned multiple ranges! This should never happen: we must have got the query wrong
-		// Return a suitably verbose error message to allow investigation
-		return nil, errors.New("data array returned by Prometheus has more than one element: url=" + url + ", returned JSON=" + string(body[:]))
+	response.warnings = thisPromQueryRangeData.Warnings
+	return &thisPromQueryRangeData, response, nil
+}
+
+// Use the specified URL to perform an instant query and return the resulting instant vector,
+// together with the response from which it was obtained
+// NaN values are filtered out
+func executePrometheusInstantRequest(ctx context.Context, url string) ([]vectorResult, *prometheusResponse, error) {
+
+	response, err := sendPrometheusRequest(ctx, url)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// how many data time-value pairs have we been given?
-	var numberOfTimeValuePairs int
-	if len(thisPromQueryRangeData.Data.Result) == 0 {
-		numberOfTimeValuePairs = 0
-	} else {
-		numberOfTimeValuePairs = len(thisPromQueryRangeData.Data.Result[0].Value)
+	thisPromQueryData := promQueryData{}
+	jsonErr := json.Unmarshal(response.body, &thisPromQueryData)
+	if jsonErr != nil {
+		return nil, nil, jsonErr
+	}
+
+	if thisPromQueryData.Status != "success" {
+		return nil, nil, errors.New("Error from Prometheus: " + thisPromQueryData.ErrorType + ": " + thisPromQueryData.Error)
+	}
+
+	if thisPromQueryData.Data.ResultType != "vector" {
+		return nil, nil, errors.New("Prometheus returned a result of type " + thisPromQueryData.Data.ResultType + " rather than vector: url=" + url)
 	}
 
+	response.warnings = thisPromQueryData.Warnings
+	results := make([]vectorResult, 0, len(thisPromQueryData.Data.Result))
+	for _, result := range thisPromQueryData.Data.Result {
+		if result.Value.ScalarValue() != "NaN" {
+			results = append(results, result)
+		}
+	}
+	return results, response, nil
+}
+
+// Send a GET request for the specified URL, which is relative to the base URL of Prometheus, and return the response
+// The request is sent to each Prometheus server in turn until one responds: a server that cannot be connected to,
+// that returns a 5xx status, or that does not respond within its share of the time remaining (see serverContext),
+// is marked as unhealthy so that the others are tried first by subsequent requests
+// The request is abandoned if ctx is cancelled or its deadline expires
+func sendPrometheusRequest(ctx context.Context, url string) (*prometheusResponse, error) {
+
+	var lastErr error
+	servers := promConnection.serversInOrder()
+	for i, server := range servers {
+		serverCtx, cancel := serverContext(ctx, len(servers)-i)
+		body, failover, err := sendPrometheusRequestToServer(serverCtx, server, url)
+		cancel()
+		if err == nil {
+			server.setHealthy(true)
+			return &prometheusResponse{body: body, server: server.String()}, nil
+		}
+		if ctx.Err() != nil {
+			// the caller has given up, so there is no point trying another server
+			return nil, err
+		}
+		if !failover {
+			// the error would be the same for every server
+			return nil, err
+		}
+		server.setHealthy(false)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Return the context to use for a request to the next Prometheus server, given the number of servers not yet tried
+// While other servers remain, each is given an equal share of the time remaining before the deadline of ctx
+// (or prometheusTimeout if it has none) so that a server that hangs does not prevent failover,
+// but the last server is given all the time remaining so that a server that is slow but healthy can still respond
+func serverContext(ctx context.Context, untriedServers int) (context.Context, context.CancelFunc) {
+
+	if untriedServers <= 1 {
+		return context.WithCancel(ctx)
+	}
+	remaining := prometheusTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining = time.Until(deadline)
+	}
+	return context.WithTimeout(ctx, remaining/time.Duration(untriedServers))
+}
+
+// Send a GET request for the specified URL to the specified Prometheus server and return the response body
+// If an error is returned, failover is true if the request should be sent to another server
+func sendPrometheusRequestToServer(ctx context.Context, server *prometheusServer, url string) (body []byte, failover bool, err error) {
+
+	req, err := http.NewRequest(http.MethodGet, server.url(url), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("User-Agent", "github.com/fnproject/ext-statsapi")
+	if err = promConnection.authorize(req); err != nil {
+		return nil, false, err
+	}
+
+	// the client is shared by all requests so that connections to Prometheus can be reused
+	res, doErr := promConnection.client.Do(req)
+	if doErr != nil {
+		return nil, true, doErr
+	}
+	defer res.Body.Close()
+
+	// Prometheus returns errors as JSON, but a proxy that rejects the credentials will not
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, false, errors.New("Error from Prometheus at " + server.String() + ": " + res.Status)
+	}
+	// a server error means this Prometheus server is unavailable or overloaded, so another should be tried
+	if res.StatusCode >= http.StatusInternalServerError {
+		return nil, true, errors.New("Error from Prometheus at " + server.String() + ": " + res.Status)
+	}
+
+	body, readErr := ioutil.ReadAll(res.Body)
+	if readErr != nil {
+		return nil, true, readErr
+	}
+	return body, false, nil
+}
+
+// Convert the time-value pairs returned by Prometheus to an array of metricsTimeValuePair structs, filtering out NaN values
+func convertTimeValuePairs(values []timeValuePair) ([]metricsTimeValuePair, error) {
+
 	// make the returned array for this metric
-	metricDataArray := make([]metricsTimeValuePair, numberOfTimeValuePairs)
-
-	if numberOfTimeValuePairs > 0 {
-		countOfNonNanValues := 0
-		// populate the array with zero or more metricsTimeValuePair strucs
-		for _, val := range thisPromQueryRangeData.Data.Result[0].Value {
-			tvp := new(metricsTimeValuePair)
-			tvp.Time = int64(val.UnixTime())
-			// filter out NaN values
-			if val.ScalarValue() != "NaN" {
-				value, err := strconv.ParseFloat(val.ScalarValue(), 64)
-				tvp.Value = value
-				if err != nil {
-					return nil, errors.New("Error converting " + val.ScalarValue() + " to a float64")
-				}
-				metricDataArray[countOfNonNanValues] = *tvp
-				countOfNonNanValues++
+	metricDataArray := make([]metricsTimeValuePair, len(values))
+
+	countOfNonNanValues := 0
+	// populate the array with zero or more metricsTimeValuePair strucs
+	for _, val := range values {
+		tvp := new(metricsTimeValuePair)
+		tvp.Time = int64(val.UnixTime())
+		// filter out NaN values
+		if val.ScalarValue() != "NaN" {
+			value, err := strconv.ParseFloat(val.ScalarValue(), 64)
+			tvp.Value = value
+			if err != nil {
+				return nil, errors.New("Error converting " + val.ScalarValue() + " to a float64")
 			}
+			metricDataArray[countOfNonNanValues] = *tvp
+			countOfNonNanValues++
 		}
-		return metricDataArray[0:countOfNonNanValues], nil
 	}
-	return metricDataArray, nil
+	return metricDataArray[0:countOfNonNanValues], nil
+}
+
+// Call the specified functions concurrently and wait for them all to return
+// If any of them returns an error, the context passed to the others is cancelled so that they can give up early,
+// and the first error is returned
+func runConcurrently(ctx context.Context, fns []func(context.Context) error) error {
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	for _, fn := range fns {
+		waitGroup.Add(1)
+		go func(fn func(context.Context) error) {
+			defer waitGroup.Done()
+			if err := fn(ctx); err != nil {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+			}
+		}(fn)
+	}
+	waitGroup.Wait()
+	return firstErr
 }
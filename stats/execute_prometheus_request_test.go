@@ -0,0 +1,88 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests check the execution of Prometheus requests and do not require an Fn server or Prometheus
+
+func TestRunConcurrently(t *testing.T) {
+
+	// every function is called, and no error is returned if none of them fail
+	var calls int32
+	succeed := func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+	assertNoError(t, "running functions that succeed", runConcurrently(context.Background(), []func(context.Context) error{succeed, succeed, succeed}))
+	assertIntsEqual(t, "Number of calls", 3, int(atomic.LoadInt32(&calls)))
+	assertNoError(t, "running no functions", runConcurrently(context.Background(), nil))
+
+	// the first error cancels the functions that are still running, which would otherwise wait for the test to time out
+	failure := errors.New("query failed")
+	fail := func(ctx context.Context) error {
+		return failure
+	}
+	wait := func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	}
+	start := time.Now()
+	if err := runConcurrently(context.Background(), []func(context.Context) error{wait, fail, wait}); err != failure {
+		t.Errorf("Expected the error of the failing function, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the waiting functions to be cancelled, but they took %v", elapsed)
+	}
+
+	// cancelling the parent context cancels every function
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runConcurrently(ctx, []func(context.Context) error{wait, wait}); err != context.Canceled {
+		t.Errorf("Expected the functions to be cancelled, got %v", err)
+	}
+}
+
+func TestWarningsAreReturned(t *testing.T) {
+
+	// Thanos returns warnings if some of the data may be missing
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		warning := "store a unavailable"
+		if strings.Contains(r.URL.Query().Get("query"), "metric_b") {
+			warning = "store b unavailable"
+		}
+		w.Write([]byte(`{"status":"success","warnings":["` + warning + `"],"data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer server.Close()
+	baseURL, err := url.Parse(server.URL)
+	assertNoError(t, "parsing server URL", err)
+
+	savedConnection := promConnection
+	defer func() { promConnection = savedConnection }()
+	promConnection = &prometheusConnection{servers: []*prometheusServer{{baseURL: baseURL}}, client: &http.Client{}}
+
+	scope := &queryScope{window: defaultWindow}
+	queries := map[string]*statisticQuery{
+		"a": {statistic: Statistic{Key: "a", Metric: "metric_a", Query: GaugeQuery(aggregationSum)}, scope: scope},
+		"b": {statistic: Statistic{Key: "b", Metric: "metric_b", Query: GaugeQuery(aggregationSum)}, scope: scope},
+		"c": {statistic: Statistic{Key: "c", Metric: "metric_a", Query: GaugeQuery(aggregationMax)}, scope: scope},
+	}
+	info, err := executeAndAddToResponse(context.Background(), &prometheusBackend{}, queries, make(map[string][]metricsTimeValuePair), nil)
+	assertNoError(t, "executing requests", err)
+
+	// duplicate warnings are removed
+	assertStringsEqual(t, "warnings", "store a unavailable,store b unavailable", strings.Join(info.warningList(), ","))
+	assertStringsEqual(t, "Prometheus servers", server.URL, strings.Join(info.sourceList(), ","))
+}
@@ -2,61 +2,141 @@ package stats
 
 import (
 	"errors"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // time format required when sending queries to Prometheus
 const prometheusTimeFormat = "2006-01-02T15:04:05.999Z07:00"
 
+// the maximum number of time-value pairs that Prometheus will return for a single range query
+const prometheusMaxPoints = 11000
+
+// the step used if none is specified, unless this would exceed the maximum number of time-value pairs
+const defaultStep = 30 * time.Second
+
+// the period over which rolling statistics are calculated, if not specified using the window parameter
+var defaultWindow = time.Minute
+
+// the interval at which Prometheus scrapes metrics from the Fn server
+var scrapeInterval = 15 * time.Second
+
+// the minimum number of scrape intervals in a window
+// a shorter window contains too few samples to calculate a rate reliably, so most values would be missing
+const minimumWindowScrapeIntervals = 4
+
+// values of the mode parameter, which determines how counter statistics are returned
+const (
+	modeCumulative = "cumulative" // the total count since each Fn server was started (the default)
+	modeRate       = "rate"       // the per-second rate of increase
+	modeIncrease   = "increase"   // the increase during each step
+)
+
+// values of the groupby parameter, which determines whether statistics are returned separately for each application, route or Fn server
+const (
+	groupByApp      = "app"      // return statistics for each application
+	groupByRoute    = "route"    // return statistics for each route in an application
+	groupByInstance = "instance" // return statistics for each Fn server
+)
+
+// URL query parameters that are passed through to Prometheus
+// These are supported by Thanos (and by some Cortex query frontends), and are ignored by Prometheus itself
+const (
+	thanosDedup               = "dedup"                 // whether to deduplicate data from Prometheus replicas
+	thanosPartialResponse     = "partial_response"      // whether to return a partial result with a warning, rather than an error, if some stores are unavailable
+	thanosMaxSourceResolution = "max_source_resolution" // the maximum resolution of downsampled data to use, or auto
+)
+
+// the values of the Thanos parameters that are used if they are not specified in the request, keyed by parameter name
+var defaultThanosParams = url.Values{}
+
+// The URL query parameters supplied by the caller, with default values generated where missing
+type queryParams struct {
+	startTime       time.Time
+	endTime         time.Time
+	step            time.Duration
+	startTimeString string        // formatted using prometheusTimeFormat
+	endTimeString   string        // formatted using prometheusTimeFormat
+	window          time.Duration // the period over which rolling statistics are calculated
+	quantiles       []float64     // optional, empty if no quantiles were requested
+	mode            string        // one of modeCumulative, modeRate or modeIncrease
+	statistics      []Statistic   // the statistics to return, a subset of those in the registry
+	groupBy         string        // optional, empty if the statistics should not be grouped
+	summary         bool          // whether to return a summary of each statistic
+	instance        string        // optional, empty if statistics from all Fn servers should be returned
+	realtime        bool          // whether to return realtime statistics, calculated from the calls made to this Fn server
+	thanosParams    url.Values    // the Thanos parameters to pass through to Prometheus, empty if none were specified or configured
+}
+
 // Extract and return the required URL query parameters, generating default values if missing
-func getQueryParams(r *http.Request) (string, string, string, error) {
+func getQueryParams(r *http.Request) (*queryParams, error) {
 
-	var starttimeString, endtimeString, stepString string
+	var starttimeString, endtimeString string
 	var starttime, endtime time.Time
+	var step time.Duration
 	var err error
 
+	// relative times such as now-1h are relative to the time the request was received
+	now := time.Now()
+
 	startTimeParams := r.URL.Query()["starttime"]
 	if len(startTimeParams) > 0 {
-		starttimeString = startTimeParams[0]
-		starttime, err = time.Parse(prometheusTimeFormat, starttimeString)
+		starttime, err = parseTime(startTimeParams[0], now)
 		if err != nil {
-			return "", "", "", errors.New("Unable to parse starttime parameter: " + err.Error())
+			return nil, errors.New("Unable to parse starttime parameter: " + err.Error())
 		}
+		starttimeString = starttime.Format(prometheusTimeFormat)
 	}
 
 	endTimeParams := r.URL.Query()["endtime"]
 	if len(endTimeParams) > 0 {
-		endtimeString = endTimeParams[0]
-		endtime, err = time.Parse(prometheusTimeFormat, endtimeString)
+		endtime, err = parseTime(endTimeParams[0], now)
 		if err != nil {
-			return "", "", "", errors.New("Unable to parse endtime parameter: " + err.Error())
+			return nil, errors.New("Unable to parse endtime parameter: " + err.Error())
+		}
+		endtimeString = endtime.Format(prometheusTimeFormat)
+	}
+
+	// last is an alternative to starttime, which specifies the length of the time period ending at endtime
+	period := time.Duration(5) * time.Minute
+	lastParams := r.URL.Query()["last"]
+	if len(lastParams) > 0 {
+		if len(startTimeParams) > 0 {
+			return nil, errors.New("starttime and last parameters cannot both be specified")
+		}
+		period, err = parseDuration(lastParams[0])
+		if err != nil {
+			return nil, errors.New("Unable to parse last parameter: " + err.Error())
 		}
 	}
 
 	stepParams := r.URL.Query()["step"]
 	if len(stepParams) > 0 {
-		stepString = stepParams[0]
-		_, err = time.ParseDuration(stepString)
+		step, err = parseDuration(stepParams[0])
 		if err != nil {
-			return "", "", "", errors.New("Unable to parse step parameter: " + err.Error())
+			return nil, errors.New("Unable to parse step parameter: " + err.Error())
 		}
 	}
 
 	switch {
 	case len(startTimeParams) == 0 && len(endTimeParams) == 0:
-		// neither starttime or endtime specified, set starttime to 5m ago, set endtime to now
-		endtime = time.Now()
+		// neither starttime or endtime specified, set starttime to 5m (or last) ago, set endtime to now
+		endtime = now
 		endtimeString = endtime.Format(prometheusTimeFormat)
-		starttime = endtime.Add(-(time.Duration(5) * time.Minute))
+		starttime = endtime.Add(-period)
 		starttimeString = starttime.Format(prometheusTimeFormat)
 	case len(startTimeParams) == 0:
-		// endtime is specified, starttime is not specified, set to 5mins before endtime
-		starttime = endtime.Add(-(time.Duration(5) * time.Minute))
+		// endtime is specified, starttime is not specified, set to 5mins (or last) before endtime
+		starttime = endtime.Add(-period)
 		starttimeString = starttime.Format(prometheusTimeFormat)
 	case len(endTimeParams) == 0:
 		// starttime is specified, endtime is not specified, set to now
-		endtime = time.Now()
+		endtime = now
 		endtimeString = endtime.Format(prometheusTimeFormat)
 	default:
 		// both starttime and endtime specified
@@ -64,13 +144,468 @@ func getQueryParams(r *http.Request) (string, string, string, error) {
 
 	if endtime.Before(starttime) {
 		err = errors.New("endtime (" + endtimeString + ") is before starttime (" + starttimeString + ")")
-		return "", "", "", err
+		return nil, err
 	}
 
+	maxPoints, err := getMaxPointsParam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prometheus rejects queries where period/step exceeds its limit, so check this before contacting it
+	// minimumStep is the smallest whole number of seconds that keeps the number of time-value pairs within maxpoints
+	period = endtime.Sub(starttime)
+	minimumStep := (period/time.Duration(maxPoints) + time.Second - 1).Truncate(time.Second)
 	if len(stepParams) == 0 {
-		// step not specified, assume 30 secs
-		stepString = time.Duration(30 * time.Second).String()
+		// step not specified, assume 30 secs unless this is too small
+		step = defaultStep
+		if int64(period/step) > int64(maxPoints) {
+			step = minimumStep
+		}
+	} else if step <= 0 {
+		return nil, errors.New("step (" + stepParams[0] + ") must be greater than zero")
+	} else if step < time.Millisecond {
+		// Prometheus durations are in whole milliseconds, so a smaller step would be sent as 0ms
+		return nil, errors.New("step (" + stepParams[0] + ") must be at least 1ms")
+	} else if int64(period/step) > int64(maxPoints) {
+		return nil, errors.New("step (" + stepParams[0] + ") is too small for the time period from " + starttimeString + " to " + endtimeString +
+			": this would return more than " + strconv.Itoa(maxPoints) + " values for each statistic. Specify a step of at least " + promDuration(minimumStep) + ", or a shorter time period")
+	}
+
+	var realtime bool
+	realtimeParams := r.URL.Query()["realtime"]
+	if len(realtimeParams) > 0 {
+		realtime, err = strconv.ParseBool(realtimeParams[0])
+		if err != nil {
+			return nil, errors.New("Unable to parse realtime parameter: " + err.Error())
+		}
+	}
+
+	window := defaultWindow
+	windowParams := r.URL.Query()["window"]
+	if len(windowParams) > 0 {
+		window, err = parseDuration(windowParams[0])
+		if err != nil {
+			return nil, errors.New("Unable to parse window parameter: " + err.Error())
+		}
+		err = validateWindow(window, realtime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	quantiles, err := getQuantilesParam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := getModeParam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	statistics, err := getMetricsParam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var groupBy string
+	groupByParams := r.URL.Query()["groupby"]
+	if len(groupByParams) > 0 {
+		groupBy = groupByParams[0]
+	}
+
+	var summary bool
+	summaryParams := r.URL.Query()["summary"]
+	if len(summaryParams) > 0 {
+		summary, err = strconv.ParseBool(summaryParams[0])
+		if err != nil {
+			return nil, errors.New("Unable to parse summary parameter: " + err.Error())
+		}
+	}
+
+	var instance string
+	instanceParams := r.URL.Query()["instance"]
+	if len(instanceParams) > 0 {
+		instance = instanceParams[0]
+	}
+
+	thanosParams, err := getThanosParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &queryParams{
+		startTime:       starttime,
+		endTime:         endtime,
+		step:            step,
+		startTimeString: starttimeString,
+		endTimeString:   endtimeString,
+		window:          window,
+		quantiles:       quantiles,
+		mode:            mode,
+		statistics:      statistics,
+		groupBy:         groupBy,
+		summary:         summary,
+		instance:        instance,
+		realtime:        realtime,
+		thanosParams:    thanosParams,
+	}
+	return params, nil
+}
+
+// Parse a time parameter, which may be
+// - a time of the form 2017-11-24T18:01:30.851Z or 2017-11-24T18:01:30Z
+// - a Unix time in seconds (such as 1511546490) or milliseconds (such as 1511546490851)
+// - now, optionally followed by a duration to add or subtract, such as now-1h
+func parseTime(timeString string, now time.Time) (time.Time, error) {
+
+	if timeString == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(timeString, "now-") || strings.HasPrefix(timeString, "now+") {
+		offset, err := parseDuration(timeString[len("now-"):])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if timeString[len("now")] == '-' {
+			return now.Add(-offset), nil
+		}
+		return now.Add(offset), nil
+	}
+
+	// assume anything later than the year 2286 in seconds is actually in milliseconds
+	if unixTime, err := strconv.ParseInt(timeString, 10, 64); err == nil {
+		if unixTime >= 1e10 {
+			if unixTime > math.MaxInt64/int64(time.Millisecond) {
+				return time.Time{}, errors.New(timeString + " is out of range")
+			}
+			return time.Unix(0, unixTime*int64(time.Millisecond)), nil
+		}
+		return time.Unix(unixTime, 0), nil
+	}
+	if unixTime, err := strconv.ParseFloat(timeString, 64); err == nil {
+		// ParseFloat accepts NaN and infinities, which have no time, and a time must fit in an int64 of nanoseconds
+		if math.IsNaN(unixTime) || math.IsInf(unixTime, 0) {
+			return time.Time{}, errors.New(timeString + " is not a finite number")
+		}
+		unit := time.Second
+		if unixTime >= 1e10 {
+			unit = time.Millisecond
+		}
+		nanoseconds := unixTime * float64(unit)
+		if nanoseconds < math.MinInt64 || nanoseconds >= math.MaxInt64 {
+			return time.Time{}, errors.New(timeString + " is out of range")
+		}
+		return time.Unix(0, int64(nanoseconds)), nil
+	}
+
+	// the fractional seconds are optional, so this also accepts RFC3339 times
+	return time.Parse(prometheusTimeFormat, timeString)
+}
+
+// units that Prometheus allows in a duration, in addition to those accepted by time.ParseDuration
+var promDurationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+var promDurationRegexp = regexp.MustCompile(`^(\d+(ms|s|m|h|d|w|y))+$`)
+var promDurationPartRegexp = regexp.MustCompile(`(\d+)(ms|s|m|h|d|w|y)`)
+
+// Parse a duration, which may be either a Prometheus-style duration such as 1d or 1w, or anything accepted by time.ParseDuration
+// Returns an error if the duration is too long to be represented
+func parseDuration(durationString string) (time.Duration, error) {
+
+	if promDurationRegexp.MatchString(durationString) {
+		var duration time.Duration
+		for _, part := range promDurationPartRegexp.FindAllStringSubmatch(durationString, -1) {
+			value, err := strconv.ParseInt(part[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			unit := promDurationUnits[part[2]]
+			if value > int64(math.MaxInt64/unit) || time.Duration(value)*unit > math.MaxInt64-duration {
+				return 0, errors.New("duration " + durationString + " is too long")
+			}
+			duration += time.Duration(value) * unit
+		}
+		return duration, nil
+	}
+	return time.ParseDuration(durationString)
+}
+
+// Check that the specified window is long enough to contain sufficient samples to calculate a rate
+// Realtime statistics are sampled every realtime interval, rather than every Prometheus scrape interval
+func validateWindow(window time.Duration, realtime bool) error {
+	if window <= 0 {
+		return errors.New("window (" + promDuration(window) + ") must be greater than zero")
+	}
+	interval, intervalName := scrapeInterval, "Prometheus scrape interval"
+	if realtime {
+		interval, intervalName = realtimeInterval, "realtime interval"
+	}
+	minimumWindow := minimumWindowScrapeIntervals * interval
+	if window < minimumWindow {
+		return errors.New("window (" + promDuration(window) + ") must be at least " + strconv.Itoa(minimumWindowScrapeIntervals) +
+			" times the " + intervalName + " (" + promDuration(interval) + "), otherwise there are too few samples to calculate a rate and most values will be missing. " +
+			"Specify a window of at least " + promDuration(minimumWindow))
+	}
+	return nil
+}
+
+// Extract the optional maxpoints parameter, which is the maximum number of time-value pairs to return for each statistic
+func getMaxPointsParam(r *http.Request) (int, error) {
+
+	maxPointsParams := r.URL.Query()["maxpoints"]
+	if len(maxPointsParams) == 0 {
+		return defaultMaxPoints, nil
+	}
+
+	maxPoints, err := strconv.Atoi(maxPointsParams[0])
+	if err != nil {
+		return 0, errors.New("Unable to parse maxpoints parameter: " + err.Error())
+	}
+	if maxPoints < 1 || maxPoints > prometheusMaxPoints {
+		return 0, errors.New("Unable to parse maxpoints parameter: " + maxPointsParams[0] + " is not between 1 and " + strconv.Itoa(prometheusMaxPoints))
 	}
+	return maxPoints, nil
+}
+
+// Extract the optional quantiles parameter, which is a comma-separated list of values such as 0.5,0.9,0.99
+func getQuantilesParam(r *http.Request) ([]float64, error) {
+
+	var quantiles []float64
+
+	quantilesParams := r.URL.Query()["quantiles"]
+	if len(quantilesParams) == 0 {
+		return quantiles, nil
+	}
+
+	for _, quantileString := range strings.Split(quantilesParams[0], ",") {
+		quantile, err := strconv.ParseFloat(strings.TrimSpace(quantileString), 64)
+		if err != nil {
+			return nil, errors.New("Unable to parse quantiles parameter: " + err.Error())
+		}
+		if quantile < 0 || quantile > 1 {
+			return nil, errors.New("Unable to parse quantiles parameter: " + quantileString + " is not between 0 and 1")
+		}
+		quantiles = append(quantiles, quantile)
+	}
+	return quantiles, nil
+}
+
+// Extract the optional mode parameter, defaulting to modeCumulative if not specified
+func getModeParam(r *http.Request) (string, error) {
 
-	return starttimeString, endtimeString, stepString, err
+	modeParams := r.URL.Query()["mode"]
+	if len(modeParams) == 0 {
+		return modeCumulative, nil
+	}
+
+	switch modeParams[0] {
+	case modeCumulative, modeRate, modeIncrease:
+		return modeParams[0], nil
+	default:
+		return "", errors.New("Unable to parse mode parameter: " + modeParams[0] + " is not one of " + modeCumulative + ", " + modeRate + " or " + modeIncrease)
+	}
+}
+
+// Extract the optional Thanos parameters, which are passed through to Prometheus
+// Any that are not specified take their values from defaultThanosParams
+func getThanosParams(r *http.Request) (url.Values, error) {
+
+	thanosParams := url.Values{}
+	for name, values := range defaultThanosParams {
+		thanosParams[name] = values
+	}
+	for _, name := range []string{thanosDedup, thanosPartialResponse, thanosMaxSourceResolution} {
+		params := r.URL.Query()[name]
+		if len(params) == 0 {
+			continue
+		}
+		value, err := parseThanosParam(name, params[0])
+		if err != nil {
+			return nil, errors.New("Unable to parse " + name + " parameter: " + err.Error())
+		}
+		thanosParams.Set(name, value)
+	}
+	return thanosParams, nil
+}
+
+// Check the value of the specified Thanos parameter, returning it in the form expected by Thanos
+func parseThanosParam(name string, value string) (string, error) {
+
+	if name == thanosMaxSourceResolution {
+		if value == "auto" {
+			return value, nil
+		}
+		resolution, err := parseDuration(value)
+		if err != nil {
+			return "", err
+		}
+		if resolution < 0 {
+			return "", errors.New(value + " is not auto or a duration of zero or more")
+		}
+		return promDuration(resolution), nil
+	}
+
+	// dedup and partial_response are booleans
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatBool(enabled), nil
+}
+
+// Extract the optional metrics parameter, which is a comma-separated list of statistics such as calls,durations
+// Returns the selected statistics from the registry, or all of them if the parameter is not specified
+func getMetricsParam(r *http.Request) ([]Statistic, error) {
+
+	metricsParams := r.URL.Query()["metrics"]
+	if len(metricsParams) == 0 {
+		return registry.all(), nil
+	}
+
+	var statistics []Statistic
+	selectedJSONKeys := make(map[string]bool)
+	for _, jsonKey := range strings.Split(metricsParams[0], ",") {
+		jsonKey = strings.TrimSpace(jsonKey)
+		statistic, ok := registry.lookup(jsonKey)
+		if !ok {
+			var validJSONKeys []string
+			for _, validStatistic := range registry.all() {
+				validJSONKeys = append(validJSONKeys, validStatistic.Key)
+			}
+			return nil, errors.New("Unable to parse metrics parameter: unknown statistic " + jsonKey + ", valid statistics are " + strings.Join(validJSONKeys, ", "))
+		}
+		if !selectedJSONKeys[jsonKey] {
+			selectedJSONKeys[jsonKey] = true
+			statistics = append(statistics, statistic)
+		}
+	}
+	return statistics, nil
+}
+
+// values of the by parameter of the top statistics API, which determines how routes are ranked
+const (
+	topByCalls      = "calls"       // the rate of calls per second
+	topByErrorRatio = "error_ratio" // the proportion of calls that failed with an error
+	topByTimeouts   = "timeouts"    // the number of calls that timed out
+	topByDurations  = "durations"   // the mean duration, or the specified quantile of the duration
+)
+
+// default number of routes returned by the top statistics API
+const defaultTopN = 10
+
+// The additional URL query parameters supplied to the top statistics API
+type topQueryParams struct {
+	by       string
+	n        int
+	quantile float64 // optional, only used if by is topByDurations, zero if the mean duration should be used
+}
+
+// Extract and return the additional URL query parameters for the top statistics API, generating default values if missing
+func getTopQueryParams(r *http.Request) (*topQueryParams, error) {
+
+	params := &topQueryParams{by: topByCalls, n: defaultTopN}
+
+	byParams := r.URL.Query()["by"]
+	if len(byParams) > 0 {
+		switch byParams[0] {
+		case topByCalls, topByErrorRatio, topByTimeouts, topByDurations:
+			params.by = byParams[0]
+		default:
+			return nil, errors.New("Unable to parse by parameter: " + byParams[0] + " is not one of " + topByCalls + ", " + topByErrorRatio + ", " + topByTimeouts + " or " + topByDurations)
+		}
+	}
+
+	nParams := r.URL.Query()["n"]
+	if len(nParams) > 0 {
+		n, err := strconv.Atoi(nParams[0])
+		if err != nil {
+			return nil, errors.New("Unable to parse n parameter: " + err.Error())
+		}
+		if n < 1 {
+			return nil, errors.New("Unable to parse n parameter: " + nParams[0] + " is not a positive number")
+		}
+		params.n = n
+	}
+
+	quantileParams := r.URL.Query()["quantile"]
+	if len(quantileParams) > 0 {
+		if params.by != topByDurations {
+			return nil, errors.New("quantile parameter is only supported when by=" + topByDurations)
+		}
+		quantile, err := strconv.ParseFloat(quantileParams[0], 64)
+		if err != nil {
+			return nil, errors.New("Unable to parse quantile parameter: " + err.Error())
+		}
+		if quantile <= 0 || quantile > 1 {
+			return nil, errors.New("Unable to parse quantile parameter: " + quantileParams[0] + " is not greater than 0 and no more than 1")
+		}
+		params.quantile = quantile
+	}
+
+	return params, nil
+}
+
+// values of the outcome parameter of the recent calls API, which are the possible statuses of a call
+var callOutcomes = []string{callStatusSuccess, callStatusError, callStatusTimeout, callStatusCancelled}
+
+// The URL query parameters supplied to the recent calls API
+type recentCallsQueryParams struct {
+	outcomes  map[string]bool // optional, nil if calls with any outcome should be returned
+	startTime time.Time       // optional, zero if calls that started at any time should be returned
+	endTime   time.Time       // optional, zero if calls that started at any time should be returned
+}
+
+// Extract and return the URL query parameters for the recent calls API
+func getRecentCallsQueryParams(r *http.Request) (*recentCallsQueryParams, error) {
+
+	params := &recentCallsQueryParams{}
+	now := time.Now()
+	var err error
+
+	outcomeParams := r.URL.Query()["outcome"]
+	if len(outcomeParams) > 0 {
+		params.outcomes = make(map[string]bool)
+		for _, outcome := range strings.Split(outcomeParams[0], ",") {
+			outcome = strings.TrimSpace(outcome)
+			valid := false
+			for _, callOutcome := range callOutcomes {
+				valid = valid || outcome == callOutcome
+			}
+			if !valid {
+				return nil, errors.New("Unable to parse outcome parameter: " + outcome + " is not one of " + strings.Join(callOutcomes, ", "))
+			}
+			params.outcomes[outcome] = true
+		}
+	}
+
+	startTimeParams := r.URL.Query()["starttime"]
+	if len(startTimeParams) > 0 {
+		params.startTime, err = parseTime(startTimeParams[0], now)
+		if err != nil {
+			return nil, errors.New("Unable to parse starttime parameter: " + err.Error())
+		}
+	}
+
+	endTimeParams := r.URL.Query()["endtime"]
+	if len(endTimeParams) > 0 {
+		params.endTime, err = parseTime(endTimeParams[0], now)
+		if err != nil {
+			return nil, errors.New("Unable to parse endtime parameter: " + err.Error())
+		}
+	}
+
+	if !params.startTime.IsZero() && !params.endTime.IsZero() && params.endTime.Before(params.startTime) {
+		return nil, errors.New("endtime (" + params.endTime.Format(prometheusTimeFormat) + ") is before starttime (" + params.startTime.Format(prometheusTimeFormat) + ")")
+	}
+	return params, nil
 }
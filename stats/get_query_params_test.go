@@ -0,0 +1,205 @@
+package stats
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// These tests check the parsing of query parameters and do not require an Fn server or Prometheus
+
+func TestParseTime(t *testing.T) {
+
+	now := time.Unix(1511546490, 0)
+	tests := []struct {
+		timeString string
+		expected   time.Time
+	}{
+		{"now", now},
+		{"now-1h", now.Add(-time.Hour)},
+		{"now+90s", now.Add(90 * time.Second)},
+		{"now-1d", now.Add(-24 * time.Hour)},
+		{"1511546490", time.Unix(1511546490, 0)},
+		{"1511546490851", time.Unix(1511546490, 851000000)},
+		{"1511546490.5", time.Unix(1511546490, 500000000)},
+		{"1511546490851.5", time.Unix(1511546490, 851500000)},
+		{"2017-11-24T18:01:30.851Z", time.Unix(1511546490, 851000000)},
+		{"2017-11-24T18:01:30Z", time.Unix(1511546490, 0)},
+		{"2017-11-24T19:01:30+01:00", time.Unix(1511546490, 0)},
+	}
+	for _, test := range tests {
+		actual, err := parseTime(test.timeString, now)
+		assertNoError(t, "parsing "+test.timeString, err)
+		// a Unix time in milliseconds with a fraction is not represented exactly, so allow for rounding
+		if difference := actual.Sub(test.expected); difference <= -time.Microsecond || difference >= time.Microsecond {
+			t.Errorf("Expected %s to be parsed as %v, got %v", test.timeString, test.expected, actual)
+		}
+	}
+
+	// the last six are not finite, or are too far from 1970 to be represented
+	for _, timeString := range []string{"", "yesterday", "now-", "now-1x", "2017-11-24", "2017-11-24T18:01:30",
+		"NaN", "Inf", "-Inf", "1e300", "-1e10", "9223372036854776"} {
+		if _, err := parseTime(timeString, now); err == nil {
+			t.Errorf("Expected an error parsing %q", timeString)
+		}
+	}
+	if _, err := getQueryParams(httptest.NewRequest("GET", "/v1/stats?starttime=NaN&endtime=Inf", nil)); err == nil {
+		t.Errorf("Expected an error for starttime=NaN&endtime=Inf")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+
+	tests := []struct {
+		durationString string
+		expected       time.Duration
+	}{
+		{"500ms", 500 * time.Millisecond},
+		{"90s", 90 * time.Second},
+		{"5m", 5 * time.Minute},
+		{"1d", 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+		{"1h30m", 90 * time.Minute},
+		{"1.5h", 90 * time.Minute},
+		{"106751d", 106751 * 24 * time.Hour},
+	}
+	for _, test := range tests {
+		actual, err := parseDuration(test.durationString)
+		assertNoError(t, "parsing "+test.durationString, err)
+		if actual != test.expected {
+			t.Errorf("Expected %s to be parsed as %v, got %v", test.durationString, test.expected, actual)
+		}
+	}
+
+	// the last three are too long to be represented
+	for _, durationString := range []string{"", "1x", "-1d", "1000000000y", "106752d", "200y200y"} {
+		if _, err := parseDuration(durationString); err == nil {
+			t.Errorf("Expected an error parsing %q", durationString)
+		}
+	}
+}
+
+func TestStepWithinMaxPoints(t *testing.T) {
+
+	tests := []struct {
+		query    string
+		expected time.Duration
+	}{
+		{"last=5m", defaultStep},
+		// the default step is increased to the smallest whole number of seconds that keeps within maxpoints
+		{"last=1w", 55 * time.Second},
+		{"last=1h&maxpoints=10", 360 * time.Second},
+		{"last=1h&maxpoints=7", 515 * time.Second},
+		// an explicit step may return exactly maxpoints values
+		{"last=1h&maxpoints=360&step=10s", 10 * time.Second},
+		{"last=1s&step=1ms", time.Millisecond},
+	}
+	for _, test := range tests {
+		params, err := getQueryParams(httptest.NewRequest("GET", "/v1/stats?"+test.query, nil))
+		assertNoError(t, "getting query parameters from "+test.query, err)
+		if params.step != test.expected {
+			t.Errorf("Expected a step of %v for %s, got %v", test.expected, test.query, params.step)
+		}
+	}
+
+	for _, query := range []string{"last=1h&maxpoints=360&step=9s", "step=0s", "last=1ms&step=1us", "last=1ms&step=999us", "maxpoints=0", "maxpoints=11001", "maxpoints=many"} {
+		if _, err := getQueryParams(httptest.NewRequest("GET", "/v1/stats?"+query, nil)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestMetricsParam(t *testing.T) {
+
+	var allJSONKeys []string
+	for _, statistic := range registry.all() {
+		allJSONKeys = append(allJSONKeys, statistic.Key)
+	}
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", strings.Join(allJSONKeys, ",")},
+		{"metrics=calls", "calls"},
+		// statistics are returned in the order requested, ignoring spaces and repeats
+		{"metrics=errors,calls", "errors,calls"},
+		{"metrics=calls,%20durations,calls", "calls,durations"},
+		{"metrics=error_ratio", "error_ratio"},
+	}
+	for _, test := range tests {
+		params, err := getQueryParams(httptest.NewRequest("GET", "/v1/stats?"+test.query, nil))
+		assertNoError(t, "getting query parameters from "+test.query, err)
+		var jsonKeys []string
+		for _, statistic := range params.statistics {
+			jsonKeys = append(jsonKeys, statistic.Key)
+		}
+		assertStringsEqual(t, "statistics selected by "+test.query, test.expected, strings.Join(jsonKeys, ","))
+	}
+
+	for _, query := range []string{"metrics=", "metrics=calls,bogus", "metrics=calls,", "metrics=Calls"} {
+		if _, err := getQueryParams(httptest.NewRequest("GET", "/v1/stats?"+query, nil)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestInvalidEnvironment(t *testing.T) {
+
+	savedMaxPoints, savedScrapeInterval, savedWindow, savedConnection := defaultMaxPoints, scrapeInterval, defaultWindow, promConnection
+	defer func() {
+		defaultMaxPoints, scrapeInterval, defaultWindow, promConnection = savedMaxPoints, savedScrapeInterval, savedWindow, savedConnection
+	}()
+
+	// an invalid environment variable is reported as an error rather than a panic, before any endpoints are added
+	for envVar, value := range map[string]string{EnvMaxPoints: "0", EnvScrapeInterval: "often", EnvWindow: "1s", EnvDefinitions: "/nonexistent/statistics.json", EnvPromURL: "localhost:9090", EnvThanosDedup: "maybe", EnvBackend: "graphite"} {
+		os.Setenv(envVar, value)
+		if err := AddEndpoints(nil); err == nil {
+			t.Errorf("Expected an error from AddEndpoints when %s=%s", envVar, value)
+		}
+		os.Unsetenv(envVar)
+		defaultMaxPoints, scrapeInterval, defaultWindow = savedMaxPoints, savedScrapeInterval, savedWindow
+	}
+
+	savedRealtimeInterval := realtimeInterval
+	defer func() { realtimeInterval = savedRealtimeInterval }()
+	for envVar, value := range map[string]string{EnvRealtimeInterval: "0s", EnvRealtimePoints: "two", EnvRecentCalls: "0"} {
+		os.Setenv(envVar, value)
+		if err := AddCallListener(nil); err == nil {
+			t.Errorf("Expected an error from AddCallListener when %s=%s", envVar, value)
+		}
+		os.Unsetenv(envVar)
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+
+	savedScrapeInterval := scrapeInterval
+	defer func() { scrapeInterval = savedScrapeInterval }()
+
+	tests := []struct {
+		window         time.Duration
+		scrapeInterval time.Duration
+		valid          bool
+	}{
+		{time.Minute, 15 * time.Second, true},
+		{59 * time.Second, 15 * time.Second, false},
+		{3 * time.Minute, time.Minute, false},
+		{4 * time.Minute, time.Minute, true},
+		{8 * time.Second, 2 * time.Second, true},
+		{0, 15 * time.Second, false},
+		{-time.Minute, 15 * time.Second, false},
+	}
+	for _, test := range tests {
+		scrapeInterval = test.scrapeInterval
+		err := validateWindow(test.window, false)
+		if test.valid && err != nil {
+			t.Errorf("Expected a window of %v to be valid with a scrape interval of %v, got %v", test.window, test.scrapeInterval, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected a window of %v to be invalid with a scrape interval of %v", test.window, test.scrapeInterval)
+		}
+	}
+}
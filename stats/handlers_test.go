@@ -0,0 +1,179 @@
+package stats
+
+import (
+	"encoding/json"
+	"github.com/fnproject/fn/api/models"
+	"net/http/httptest"
+	"testing"
+)
+
+// These tests use a memoryBackend, so they do not need Prometheus or an Fn server
+
+// Replace statisticsBackend with a memoryBackend for the duration of a test, returning a function that restores it
+func useMemoryBackend() (*memoryBackend, func()) {
+	savedBackend := statisticsBackend
+	backend := newMemoryBackend()
+	statisticsBackend = backend
+	return backend, func() { statisticsBackend = savedBackend }
+}
+
+func TestHandleWithMemoryBackend(t *testing.T) {
+
+	backend, restore := useMemoryBackend()
+	defer restore()
+	backend.add("calls", "myapp", "", "", metricsTimeValuePair{Time: 1000, Value: 1}, metricsTimeValuePair{Time: 1010, Value: 4}, metricsTimeValuePair{Time: 2000, Value: 9})
+	backend.add("durations_p99", "myapp", "", "", metricsTimeValuePair{Time: 1010, Value: 0.5})
+	backend.add("errors", "myapp", "", "", metricsTimeValuePair{Time: 1010, Value: 2})
+	backend.add("calls", "otherapp", "", "", metricsTimeValuePair{Time: 1010, Value: 100})
+
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/stats?metrics=calls&quantiles=0.99&starttime=1000&endtime=1100&summary=true", nil)
+	var response metricsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handle(r, "myapp", ""), &response))
+
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+	assertIntsEqual(t, "Number of calls values", 2, len(response.Data["calls"]))
+	assertIntsEqual(t, "Number of durations_p99 values", 1, len(response.Data["durations_p99"]))
+	if _, ok := response.Data["errors"]; ok {
+		t.Errorf("Expected no errors, which were not requested, got %v", response.Data["errors"])
+	}
+	if _, ok := response.Summary["errors"]; ok {
+		t.Errorf("Expected no summary of errors, which were not requested, got %+v", response.Summary["errors"])
+	}
+	if response.Summary["calls"] == nil || response.Summary["calls"].Increase == nil || *response.Summary["calls"].Increase != 3 {
+		t.Errorf("Expected the summary of calls to have an increase of 3, got %+v", response.Summary["calls"])
+	}
+	if len(response.Prometheus) != 0 {
+		t.Errorf("Expected no Prometheus servers in the response, got %v", response.Prometheus)
+	}
+}
+
+func TestGroupedHandleWithMemoryBackend(t *testing.T) {
+
+	backend, restore := useMemoryBackend()
+	defer restore()
+	backend.add("calls", "myapp", "/hello", "", metricsTimeValuePair{Time: 1000, Value: 1})
+	backend.add("calls", "myapp", "/goodbye", "", metricsTimeValuePair{Time: 1000, Value: 2})
+	backend.add("errors", "myapp", "/goodbye", "", metricsTimeValuePair{Time: 1000, Value: 1})
+	backend.add("timeouts", "myapp", "/goodbye", "", metricsTimeValuePair{Time: 1000, Value: 1})
+	backend.add("calls", "otherapp", "/hello", "", metricsTimeValuePair{Time: 1000, Value: 3})
+
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/stats?metrics=calls,errors&groupby=route&starttime=900&endtime=1100", nil)
+	var response metricsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handle(r, "myapp", ""), &response))
+
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+	assertIntsEqual(t, "Number of routes", 2, len(response.Routes))
+	assertIntsEqual(t, "Number of calls values for /hello", 1, len(response.Routes["/hello"]["calls"]))
+	if response.Routes["/hello"]["errors"] == nil || len(response.Routes["/hello"]["errors"]) != 0 {
+		t.Errorf("Expected an empty array of errors for /hello, got %v", response.Routes["/hello"]["errors"])
+	}
+	if _, ok := response.Routes["/goodbye"]["timeouts"]; ok {
+		t.Errorf("Expected no timeouts for /goodbye, which were not requested, got %v", response.Routes["/goodbye"]["timeouts"])
+	}
+}
+
+func TestHandleGroupedByAppWithMemoryBackend(t *testing.T) {
+
+	backend, restore := useMemoryBackend()
+	defer restore()
+	backend.add("calls", "", "", "", metricsTimeValuePair{Time: 1000, Value: 6})
+	backend.add("calls", "myapp", "", "", metricsTimeValuePair{Time: 1000, Value: 1})
+	backend.add("calls", "otherapp", "", "", metricsTimeValuePair{Time: 1000, Value: 5})
+	backend.add("calls", "myapp", "/hello", "", metricsTimeValuePair{Time: 1000, Value: 1})
+
+	r := httptest.NewRequest("GET", "/v1/stats?metrics=calls&groupby=app&starttime=900&endtime=1100", nil)
+	var response metricsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handle(r, "", ""), &response))
+
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+	assertIntsEqual(t, "Number of apps", 2, len(response.Apps))
+	assertIntsEqual(t, "Number of calls values for otherapp", 1, len(response.Apps["otherapp"]["calls"]))
+	assertFloatsEqual(t, "calls for otherapp", 5, response.Apps["otherapp"]["calls"][0].Value)
+	if response.Data != nil || response.Routes != nil {
+		t.Errorf("Expected only apps in the response, got data %v and routes %v", response.Data, response.Routes)
+	}
+}
+
+func TestGetGroupByLabel(t *testing.T) {
+
+	tests := []struct {
+		groupBy   string
+		appName   string
+		routeName string
+		expected  string
+	}{
+		{"", "", "", ""},
+		{groupByApp, "", "", appLabel},
+		{groupByRoute, "myapp", "", routeLabel},
+		{groupByInstance, "", "", instanceLabel},
+		{groupByInstance, "myapp", "/hello", instanceLabel},
+	}
+	for _, test := range tests {
+		label, err := getGroupByLabel(test.groupBy, test.appName, test.routeName)
+		assertNoError(t, "getting the label for groupby="+test.groupBy, err)
+		assertStringsEqual(t, "label for groupby="+test.groupBy, test.expected, label)
+	}
+
+	// applications can only be grouped at global scope, and routes only at application scope
+	for _, test := range []struct{ groupBy, appName, routeName string }{
+		{groupByApp, "myapp", ""},
+		{groupByApp, "myapp", "/hello"},
+		{groupByRoute, "", ""},
+		{groupByRoute, "myapp", "/hello"},
+		{"function", "", ""},
+	} {
+		if _, err := getGroupByLabel(test.groupBy, test.appName, test.routeName); err == nil {
+			t.Errorf("Expected an error for groupby=%s for application %q and route %q", test.groupBy, test.appName, test.routeName)
+		}
+	}
+}
+
+func TestGroupedHandlerWritesNamesUnchanged(t *testing.T) {
+
+	backend, restore := useMemoryBackend()
+	defer restore()
+	backend.add("calls", "myapp", "/100%done", "", metricsTimeValuePair{Time: 1000, Value: 1})
+
+	// a route name containing % must not be treated as part of a format string
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/stats?metrics=calls&groupby=route&starttime=900&endtime=1100", nil)
+	(&appStatisticsHandler{}).ServeHTTP(w, r, &models.App{Name: "myapp"})
+	var response metricsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(w.Body.Bytes(), &response))
+	assertIntsEqual(t, "Number of calls values for /100%done", 1, len(response.Routes["/100%done"]["calls"]))
+}
+
+func TestHandleCurrentWithMemoryBackend(t *testing.T) {
+
+	backend, restore := useMemoryBackend()
+	defer restore()
+	backend.add("calls", "myapp", "/hello", "", metricsTimeValuePair{Time: 1000, Value: 1}, metricsTimeValuePair{Time: 1010, Value: 4})
+	backend.add("timeouts", "myapp", "/hello", "", metricsTimeValuePair{Time: 1000, Value: 1})
+
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/routes/hello/stats/current?metrics=calls,errors&endtime=1005", nil)
+	var response currentMetricsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handleCurrent(r, "myapp", "/hello"), &response))
+
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+	if response.Data["calls"] == nil || *response.Data["calls"] != 1 {
+		t.Errorf("Expected calls to be 1, got %v", response.Data["calls"])
+	}
+	if value, ok := response.Data["errors"]; !ok || value != nil {
+		t.Errorf("Expected errors to be null")
+	}
+	if _, ok := response.Data["timeouts"]; ok {
+		t.Errorf("Expected no timeouts, which were not requested, got %v", response.Data["timeouts"])
+	}
+}
+
+func TestHandleTopWithMemoryBackend(t *testing.T) {
+
+	_, restore := useMemoryBackend()
+	defer restore()
+
+	r := httptest.NewRequest("GET", "/stats/top", nil)
+	var response errorResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handleTop(r, ""), &response))
+	assertStringsEqual(t, "status", STATS_STATUS_ERROR, response.Status)
+	assertStringsEqual(t, "error", "top statistics are only supported when statistics are obtained from Prometheus", response.Error)
+}
@@ -24,6 +24,8 @@ func (e *statisticsExt) Name() string {
 }
 
 func (e *statisticsExt) Setup(s fnext.ExtServer) error {
-	AddEndpoints(s)
-	return nil
+	if err := AddEndpoints(s); err != nil {
+		return err
+	}
+	return AddCallListener(s)
 }
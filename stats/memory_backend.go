@@ -0,0 +1,150 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// A queryBackend that holds the values of statistics in memory, which allows the statistics APIs to be used without Prometheus,
+// such as when testing handlers
+// Values are added for a statistic at a particular scope, and are returned by queries for exactly that scope:
+// no aggregation is performed, and the mode, window and step of a query are ignored,
+// except that the current value of a counter in increase mode is its increase over the step
+type memoryBackend struct {
+	mutex  sync.RWMutex
+	series map[memorySeriesKey][]metricsTimeValuePair // protected by mutex, each sorted by time
+}
+
+// Identifies the values of a statistic at a particular scope
+type memorySeriesKey struct {
+	jsonKey      string // the key that will hold the statistic in the returned JSON data structure, such as calls or durations_p99
+	appName      string // empty for all applications
+	routeName    string // empty for all routes
+	instanceName string // empty for all Fn servers
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{series: make(map[memorySeriesKey][]metricsTimeValuePair)}
+}
+
+// Add values of the statistic with the specified key for the specified application, route and Fn server,
+// any of which may be empty to add values for all of them
+func (backend *memoryBackend) add(jsonKey string, appName string, routeName string, instanceName string, values ...metricsTimeValuePair) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	key := memorySeriesKey{jsonKey: jsonKey, appName: appName, routeName: routeName, instanceName: instanceName}
+	series := append(backend.series[key], values...)
+	sort.SliceStable(series, func(i, j int) bool { return series[i].Time < series[j].Time })
+	backend.series[key] = series
+}
+
+// Return the values of the statistic between the start and end of the query, inclusive
+// If the query is grouped, return the values for each scope that differs from that of the query only by the grouped label
+func (backend *memoryBackend) QueryRange(ctx context.Context, query *statisticQuery) (*rangeResult, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	startTime, endTime := query.startTime.Unix(), query.endTime.Unix()
+	queryKey := newMemorySeriesKey(query)
+	if query.scope.groupByLabel == "" {
+		return &rangeResult{values: valuesBetween(backend.series[queryKey], startTime, endTime)}, nil
+	}
+
+	groupedValues := make(map[string][]metricsTimeValuePair)
+	for key, series := range backend.series {
+		labelValue := key.labelValue(query.scope.groupByLabel)
+		if labelValue != "" && key.withLabelValue(query.scope.groupByLabel, "") == queryKey {
+			groupedValues[labelValue] = valuesBetween(series, startTime, endTime)
+		}
+	}
+	return &rangeResult{groupedValues: groupedValues}, nil
+}
+
+// Return the latest value of the statistic at or before the end of the query, or nil if there is none
+// If the statistic is a counter in increase mode, return its increase over the step ending at the end of the query,
+// or nil if there are fewer than two values in that step
+func (backend *memoryBackend) QueryCurrent(ctx context.Context, query *statisticQuery) (*currentResult, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	series := backend.series[newMemorySeriesKey(query)]
+	endTime := query.endTime.Unix()
+	if query.quantile == nil && query.statistic.Query.isCounter() && query.mode == modeIncrease {
+		values := valuesBetween(series, query.endTime.Add(-query.scope.step).Unix(), endTime)
+		if len(values) < 2 {
+			return &currentResult{}, nil
+		}
+		var increase float64
+		for i := 1; i < len(values); i++ {
+			if values[i].Value >= values[i-1].Value {
+				increase += values[i].Value - values[i-1].Value
+			} else {
+				// the counter has been reset (for example because a Fn server was restarted)
+				increase += values[i].Value
+			}
+		}
+		return &currentResult{value: &increase}, nil
+	}
+	for i := len(series) - 1; i >= 0; i-- {
+		if series[i].Time <= endTime {
+			value := series[i].Value
+			return &currentResult{value: &value}, nil
+		}
+	}
+	return &currentResult{}, nil
+}
+
+// Top statistics are not supported, because routes can only be ranked by Prometheus
+func (backend *memoryBackend) QueryTop(ctx context.Context, query *topQuery) (*topResult, error) {
+	return nil, errors.New("top statistics are only supported when statistics are obtained from Prometheus")
+}
+
+// Return the key of the values requested by the specified query, ignoring any grouping
+func newMemorySeriesKey(query *statisticQuery) memorySeriesKey {
+	return memorySeriesKey{
+		jsonKey:      query.jsonKey(),
+		appName:      query.scope.appName,
+		routeName:    query.scope.routeName,
+		instanceName: query.scope.instanceName,
+	}
+}
+
+// Return the value of the specified Prometheus label in this key
+func (key memorySeriesKey) labelValue(label string) string {
+	switch label {
+	case appLabel:
+		return key.appName
+	case routeLabel:
+		return key.routeName
+	case instanceLabel:
+		return key.instanceName
+	default:
+		return ""
+	}
+}
+
+// Return a copy of this key in which the specified Prometheus label has the specified value
+func (key memorySeriesKey) withLabelValue(label string, value string) memorySeriesKey {
+	switch label {
+	case appLabel:
+		key.appName = value
+	case routeLabel:
+		key.routeName = value
+	case instanceLabel:
+		key.instanceName = value
+	}
+	return key
+}
+
+// Return a copy of the values in the specified series, which is sorted by time, between startTime and endTime inclusive
+func valuesBetween(series []metricsTimeValuePair, startTime int64, endTime int64) []metricsTimeValuePair {
+	values := make([]metricsTimeValuePair, 0)
+	for _, tvp := range series {
+		if tvp.Time >= startTime && tvp.Time <= endTime {
+			values = append(values, tvp)
+		}
+	}
+	return values
+}
@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// The queryBackend that obtains statistics from Prometheus, using promConnection
+type prometheusBackend struct{}
+
+// Return the values of the statistic over the requested range, obtained using a Prometheus range query
+func (backend *prometheusBackend) QueryRange(ctx context.Context, query *statisticQuery) (*rangeResult, error) {
+
+	url := buildPrometheusRequest(query.promQueryBuilder(), query.statistic.Metric, query.scope,
+		query.startTime.Format(prometheusTimeFormat), query.endTime.Format(prometheusTimeFormat), query.extraParams)
+
+	if query.scope.groupByLabel == "" {
+		metricDataArray, response, err := executePrometheusRequest(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return &rangeResult{values: metricDataArray, source: response.server, warnings: response.warnings}, nil
+	}
+
+	metricDataArrays, response, err := executeGroupedPrometheusRequest(ctx, url, query.scope.groupByLabel)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeResult{groupedValues: metricDataArrays, source: response.server, warnings: response.warnings}, nil
+}
+
+// Return the value of the statistic at the requested time, obtained using a Prometheus instant query
+func (backend *prometheusBackend) QueryCurrent(ctx context.Context, query *statisticQuery) (*currentResult, error) {
+
+	promQuery := query.promQueryBuilder()(query.statistic.Metric, query.scope)
+	value, response, err := executeCurrentRequest(ctx, promQuery, query.endTime.Format(prometheusTimeFormat), query.extraParams)
+	if err != nil {
+		return nil, err
+	}
+	return &currentResult{value: value, source: response.server, warnings: response.warnings}, nil
+}
+
+// Return the routes with the highest values of the statistic, obtained using a single Prometheus instant query
+func (backend *prometheusBackend) QueryTop(ctx context.Context, query *topQuery) (*topResult, error) {
+
+	promQuery := buildTopQuery(query.by, query.quantile, query.n, query.scope)
+	url := buildPrometheusInstantRequest(promQuery, query.endTime.Format(prometheusTimeFormat), query.extraParams)
+	results, response, err := executePrometheusInstantRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]topRoute, 0, len(results))
+	for _, result := range results {
+		value, err := strconv.ParseFloat(result.Value.ScalarValue(), 64)
+		if err != nil {
+			return nil, errors.New("Error converting " + result.Value.ScalarValue() + " to a float64")
+		}
+		routes = append(routes, topRoute{App: result.Metric[appLabel], Route: result.Metric[routeLabel], Value: value})
+	}
+	// topk does not return its results in order
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Value > routes[j].Value
+	})
+	return &topResult{routes: routes, source: response.server, warnings: response.warnings}, nil
+}
+
+// Return the function that builds the Prometheus query for the statistic
+// Counters are returned as cumulative values unless another mode was requested
+func (query *statisticQuery) promQueryBuilder() queryBuilderFunc {
+	if query.quantile != nil {
+		return queryBuilderForHistogramQuantile(*query.quantile)
+	}
+	if query.statistic.Query.isCounter() && query.mode != "" && query.mode != modeCumulative {
+		return queryBuilderForCounterMode(query.mode)
+	}
+	return query.statistic.Query.queryBuilder()
+}
+
+// Evaluate the specified Prometheus query at the specified time and return its value,
+// together with the response from which it was obtained
+// Returns nil if Prometheus has no value for the query at that time
+func executeCurrentRequest(ctx context.Context, query string, timeString string, thanosParams url.Values) (*float64, *prometheusResponse, error) {
+
+	url := buildPrometheusInstantRequest(query, timeString, thanosParams)
+	results, response, err := executePrometheusInstantRequest(ctx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch len(results) {
+	case 0:
+		return nil, response, nil
+	case 1:
+		value, err := strconv.ParseFloat(results[0].Value.ScalarValue(), 64)
+		if err != nil {
+			return nil, nil, errors.New("Error converting " + results[0].Value.ScalarValue() + " to a float64")
+		}
+		return &value, response, nil
+	default:
+		// This should never happen: we must have got the query wrong
+		return nil, nil, errors.New("vector returned by Prometheus has more than one element: url=" + url)
+	}
+}
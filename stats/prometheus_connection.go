@@ -0,0 +1,299 @@
+package stats
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/fnproject/ext-statsapi/fncommon"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a Prometheus server that failed to respond is avoided, unless no other server is available
+const unhealthyServerRetryInterval = 30 * time.Second
+
+// The configuration used to connect to Prometheus, usually obtained from environment variables
+type prometheusConnectionConfig struct {
+	baseURLs           []string // the URL of each Prometheus server, including any path prefix, such as https://prometheus.example.com/prometheus
+	username           string   // optional, the username to use for basic authentication
+	password           string   // optional, the password to use for basic authentication
+	passwordFile       string   // optional, a file containing the password to use for basic authentication
+	bearerToken        string   // optional, the token to use for bearer token authentication
+	bearerTokenFile    string   // optional, a file containing the token to use for bearer token authentication
+	caFile             string   // optional, a file containing the PEM-encoded certificates of the CAs used to verify Prometheus
+	certFile           string   // optional, a file containing the PEM-encoded client certificate, for mutual TLS
+	keyFile            string   // optional, a file containing the PEM-encoded private key of the client certificate
+	insecureSkipVerify bool     // whether to skip verifying the certificate of Prometheus (only for use in test environments)
+}
+
+// A connection to Prometheus, used to send all requests
+// This may consist of several Prometheus servers (such as a HA pair) containing the same data
+type prometheusConnection struct {
+	servers         []*prometheusServer // in the order in which they were configured
+	client          *http.Client
+	username        string
+	password        string
+	passwordFile    string // if not empty, read each time a request is sent, so that a changed password is used
+	bearerToken     string
+	bearerTokenFile string // if not empty, read each time a request is sent, so that a renewed token is used
+}
+
+// A single Prometheus server
+type prometheusServer struct {
+	baseURL        *url.URL // the scheme, host and optional path prefix of all requests, with no credentials
+	mutex          sync.Mutex
+	unhealthyUntil time.Time // protected by mutex, zero if the last request succeeded
+}
+
+// the connection to Prometheus, which by default is the same as http://localhost:9090
+var promConnection = &prometheusConnection{
+	servers: []*prometheusServer{{baseURL: &url.URL{Scheme: "http", Host: "localhost:9090"}}},
+	client:  &http.Client{},
+}
+
+// Return the configuration for connecting to Prometheus, obtained from environment variables
+// EnvPromURL may contain a comma-separated list of URLs
+// If it is not set, a single URL is constructed from EnvPromHost and EnvPromPort
+func getPrometheusConnectionConfigFromEnv() (*prometheusConnectionConfig, error) {
+
+	var baseURLs []string
+	for _, baseURL := range strings.Split(fncommon.GetEnv(EnvPromURL, ""), ",") {
+		if baseURL = strings.TrimSpace(baseURL); baseURL != "" {
+			baseURLs = append(baseURLs, baseURL)
+		}
+	}
+	if len(baseURLs) == 0 {
+		promHost := fncommon.GetEnv(EnvPromHost, "localhost")
+		promPort := fncommon.GetEnv(EnvPromPort, "9090")
+		baseURLs = []string{"http://" + net.JoinHostPort(promHost, promPort)}
+	}
+
+	var insecureSkipVerify bool
+	if insecureSkipVerifyString := fncommon.GetEnv(EnvPromInsecureSkipVerify, ""); insecureSkipVerifyString != "" {
+		var err error
+		insecureSkipVerify, err = strconv.ParseBool(insecureSkipVerifyString)
+		if err != nil {
+			return nil, errors.New(EnvPromInsecureSkipVerify + ": " + err.Error())
+		}
+	}
+
+	config := &prometheusConnectionConfig{
+		baseURLs:           baseURLs,
+		username:           fncommon.GetEnv(EnvPromUsername, ""),
+		password:           fncommon.GetEnv(EnvPromPassword, ""),
+		passwordFile:       fncommon.GetEnv(EnvPromPasswordFile, ""),
+		bearerToken:        fncommon.GetEnv(EnvPromBearerToken, ""),
+		bearerTokenFile:    fncommon.GetEnv(EnvPromBearerTokenFile, ""),
+		caFile:             fncommon.GetEnv(EnvPromCAFile, ""),
+		certFile:           fncommon.GetEnv(EnvPromCertFile, ""),
+		keyFile:            fncommon.GetEnv(EnvPromKeyFile, ""),
+		insecureSkipVerify: insecureSkipVerify,
+	}
+	return config, nil
+}
+
+// Create a connection to Prometheus using the specified configuration
+// Returns an error if the configuration is inconsistent, or if any of the specified files cannot be read
+func newPrometheusConnection(config *prometheusConnectionConfig) (*prometheusConnection, error) {
+
+	if len(config.baseURLs) == 0 {
+		return nil, errors.New("No Prometheus URL was specified")
+	}
+
+	connection := &prometheusConnection{
+		username:        config.username,
+		password:        config.password,
+		passwordFile:    config.passwordFile,
+		bearerToken:     config.bearerToken,
+		bearerTokenFile: config.bearerTokenFile,
+	}
+
+	usernameInURL := false
+	for _, baseURLString := range config.baseURLs {
+		baseURL, err := url.Parse(baseURLString)
+		if err != nil {
+			return nil, errors.New("Unable to parse Prometheus URL: " + err.Error())
+		}
+		if (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+			return nil, errors.New("Unable to parse Prometheus URL: " + baseURLString + " is not an absolute http or https URL")
+		}
+		if baseURL.RawQuery != "" || baseURL.Fragment != "" {
+			return nil, errors.New("Unable to parse Prometheus URL: " + baseURLString + " must not contain a query or fragment")
+		}
+
+		// credentials in the URL are used for basic authentication, and removed so that they are not included in error messages
+		// since they are used for every Prometheus server, each URL that contains credentials must contain the same ones
+		if baseURL.User != nil {
+			username := baseURL.User.Username()
+			password, _ := baseURL.User.Password()
+			if usernameInURL && (username != connection.username || password != connection.password) {
+				return nil, errors.New("Prometheus URLs must not contain different credentials")
+			}
+			if !usernameInURL && connection.username != "" {
+				return nil, errors.New("Prometheus username must not be specified both in the URL and separately")
+			}
+			connection.username = username
+			connection.password = password
+			usernameInURL = true
+			baseURL.User = nil
+		}
+		connection.servers = append(connection.servers, &prometheusServer{baseURL: baseURL})
+	}
+
+	if connection.password != "" && connection.passwordFile != "" {
+		return nil, errors.New("Prometheus password and password file cannot both be specified")
+	}
+	if connection.bearerToken != "" && connection.bearerTokenFile != "" {
+		return nil, errors.New("Prometheus bearer token and bearer token file cannot both be specified")
+	}
+	usesBasicAuth := connection.username != "" || connection.password != "" || connection.passwordFile != ""
+	usesBearerToken := connection.bearerToken != "" || connection.bearerTokenFile != ""
+	if usesBasicAuth && usesBearerToken {
+		return nil, errors.New("Prometheus basic authentication and bearer token authentication cannot both be specified")
+	}
+	// check that any credentials files can be read now, rather than when the first request is sent
+	if _, err := connection.getCredentials(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newPrometheusTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	connection.client = &http.Client{}
+	if tlsConfig != nil {
+		connection.client.Transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConns:        100,
+		}
+	}
+	return connection, nil
+}
+
+// Return the TLS configuration for connecting to Prometheus, or nil if the default configuration should be used
+func newPrometheusTLSConfig(config *prometheusConnectionConfig) (*tls.Config, error) {
+
+	if config.caFile == "" && config.certFile == "" && config.keyFile == "" && !config.insecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.insecureSkipVerify}
+
+	if config.caFile != "" {
+		caCerts, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, errors.New("Unable to read Prometheus CA file: " + err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, errors.New("Unable to read Prometheus CA file: " + config.caFile + " does not contain any PEM-encoded certificates")
+		}
+	}
+
+	if config.certFile != "" || config.keyFile != "" {
+		if config.certFile == "" || config.keyFile == "" {
+			return nil, errors.New("Prometheus client certificate file and key file must both be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+		if err != nil {
+			return nil, errors.New("Unable to read Prometheus client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Return the servers in the order in which they should be tried
+// Healthy servers are tried first in the order in which they were configured, followed by unhealthy servers,
+// which are only used if all the others fail
+func (connection *prometheusConnection) serversInOrder() []*prometheusServer {
+	now := time.Now()
+	var healthy, unhealthy []*prometheusServer
+	for _, server := range connection.servers {
+		if server.isHealthy(now) {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Return whether the server is healthy at the specified time
+func (server *prometheusServer) isHealthy(now time.Time) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return !now.Before(server.unhealthyUntil)
+}
+
+// Record whether the last request sent to the server succeeded
+// A server that failed is avoided for unhealthyServerRetryInterval
+func (server *prometheusServer) setHealthy(healthy bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if healthy {
+		server.unhealthyUntil = time.Time{}
+	} else {
+		server.unhealthyUntil = time.Now().Add(unhealthyServerRetryInterval)
+	}
+}
+
+// Return the complete URL for the specified request URL, which is relative to the base URL of the server
+func (server *prometheusServer) url(requestURL string) string {
+	return strings.TrimSuffix(server.baseURL.String(), "/") + requestURL
+}
+
+// Return the base URL of the server, which is used to identify it in responses
+func (server *prometheusServer) String() string {
+	return server.baseURL.String()
+}
+
+// Return the value of the Authorization header to send to Prometheus, or an empty string if no credentials are configured
+func (connection *prometheusConnection) getCredentials() (string, error) {
+
+	bearerToken := connection.bearerToken
+	if connection.bearerTokenFile != "" {
+		token, err := ioutil.ReadFile(connection.bearerTokenFile)
+		if err != nil {
+			return "", errors.New("Unable to read Prometheus bearer token file: " + err.Error())
+		}
+		bearerToken = strings.TrimSpace(string(token))
+	}
+	if bearerToken != "" {
+		return "Bearer " + bearerToken, nil
+	}
+
+	password := connection.password
+	if connection.passwordFile != "" {
+		passwordBytes, err := ioutil.ReadFile(connection.passwordFile)
+		if err != nil {
+			return "", errors.New("Unable to read Prometheus password file: " + err.Error())
+		}
+		password = strings.TrimSpace(string(passwordBytes))
+	}
+	if connection.username != "" || password != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(connection.username+":"+password)), nil
+	}
+	return "", nil
+}
+
+// Add any configured credentials to the specified request
+func (connection *prometheusConnection) authorize(req *http.Request) error {
+	credentials, err := connection.getCredentials()
+	if err != nil {
+		return err
+	}
+	if credentials != "" {
+		req.Header.Set("Authorization", credentials)
+	}
+	return nil
+}
@@ -6,10 +6,11 @@ const PROM_STATUS_ERROR string = "error"
 const PROM_STATUS_SUCCESS string = "success"
 
 type promQueryRangeData struct {
-	Status    string `json:"status"`    // "success" | "error" | ?
-	Error     string `json:"errorType"` // only present if status=error
-	ErrorType string `json:"error"`     // only present if status=error
-	Data      data   `json:"data"`
+	Status    string   `json:"status"`    // "success" | "error" | ?
+	Error     string   `json:"errorType"` // only present if status=error
+	ErrorType string   `json:"error"`     // only present if status=error
+	Data      data     `json:"data"`
+	Warnings  []string `json:"warnings"` // optional, returned by Thanos if the result may be incomplete
 }
 
 type data struct {
@@ -33,3 +34,23 @@ func (tvp timeValuePair) ScalarValue() string {
 	result, _ := tvp[1].(string)
 	return result
 }
+
+// the following structs represent the JSON returned by Prometheus API from an instant query
+
+type promQueryData struct {
+	Status    string     `json:"status"`    // "success" | "error" | ?
+	ErrorType string     `json:"errorType"` // only present if status=error
+	Error     string     `json:"error"`     // only present if status=error
+	Data      vectorData `json:"data"`
+	Warnings  []string   `json:"warnings"` // optional, returned by Thanos if the result may be incomplete
+}
+
+type vectorData struct {
+	ResultType string         `json:"resultType"` // "vector" (Instant vectors)
+	Result     []vectorResult `json:"result"`
+}
+
+type vectorResult struct { // Used when resultType is vector
+	Metric map[string]string `json:"metric"` // Map of label_name to label_value (empty if this is a sum)
+	Value  timeValuePair     `json:"value"`
+}
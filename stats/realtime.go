@@ -0,0 +1,164 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"github.com/fnproject/ext-statsapi/fncommon"
+	"github.com/fnproject/fn/api/models"
+	"github.com/fnproject/fn/fnext"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Realtime statistics are calculated from the calls made to this Fn server, which are observed using a CallListener,
+// rather than from metrics scraped by Prometheus every scrape interval, so they are up to date within a second
+// The listener maintains its own counters and histogram of durations in a separate registry, which is gathered
+// every realtime interval by an embeddedBackend, so realtime statistics are calculated in the same way as in embedded mode
+// They are requested by specifying realtime=true, and cover only this Fn server
+
+// the default interval at which the realtime metrics are gathered
+const defaultRealtimeInterval = time.Second
+
+// the default number of samples held for each realtime series, which is five minutes at the default realtime interval
+const defaultRealtimePoints = 300
+
+// the upper bounds of the buckets of the realtime histogram of durations, in seconds
+var realtimeDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// values of the status of a call, set by the Fn server when the call ends
+const (
+	callStatusSuccess   = "success"
+	callStatusError     = "error"
+	callStatusTimeout   = "timeout"
+	callStatusCancelled = "cancelled"
+)
+
+// the interval at which the realtime metrics are gathered
+var realtimeInterval = defaultRealtimeInterval
+
+// the source of statistics requested with realtime=true, nil if the call listener has not been registered
+var realtimeBackend queryBackend
+
+// The CallListener that counts the calls to each route of each application
+type realtimeListener struct {
+	calls     *prometheus.CounterVec
+	completed *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+	timeouts  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+}
+
+// AddCallListener registers CallListeners that maintain realtime statistics, which it starts gathering, and record recent calls
+// Returns an error if any of the environment variables is invalid, in which case no CallListeners are registered
+func AddCallListener(s fnext.ExtServer) error {
+
+	var err error
+	if realtimeInterval, err = parseDuration(fncommon.GetEnv(EnvRealtimeInterval, promDuration(defaultRealtimeInterval))); err != nil {
+		return errors.New(EnvRealtimeInterval + ": " + err.Error())
+	}
+	if realtimeInterval <= 0 {
+		return errors.New(EnvRealtimeInterval + " must be positive")
+	}
+	points, err := fncommon.GetEnvIntOrError(EnvRealtimePoints, defaultRealtimePoints)
+	if err != nil {
+		return err
+	}
+	if points < 2 {
+		return errors.New(EnvRealtimePoints + " must be at least 2")
+	}
+	recentCallsCapacity, err := fncommon.GetEnvIntOrError(EnvRecentCalls, defaultRecentCalls)
+	if err != nil {
+		return err
+	}
+	if recentCallsCapacity < 1 {
+		return errors.New(EnvRecentCalls + " must be at least 1")
+	}
+
+	registry := prometheus.NewRegistry()
+	s.AddCallListener(newRealtimeListener(registry))
+	backend := newEmbeddedBackend(registry, points, nil)
+	go backend.run(realtimeInterval)
+	realtimeBackend = backend
+
+	recentCallsListener = newRecentCalls(recentCallsCapacity)
+	s.AddCallListener(recentCallsListener)
+	return nil
+}
+
+// Create a realtime listener whose metrics are registered with the specified registerer,
+// using the same names and labels as the equivalent metrics of the Fn server
+func newRealtimeListener(registerer prometheus.Registerer) *realtimeListener {
+	labels := []string{appLabel, routeLabel}
+	counter := func(metricName string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: metricName, Help: "Realtime count of " + metricName}, labels)
+	}
+	listener := &realtimeListener{
+		calls:     counter(promMetricNames[callsConst]),
+		completed: counter(promMetricNames[completedConst]),
+		failed:    counter(promMetricNames[failedConst]),
+		errors:    counter(promMetricNames[errorsConst]),
+		timeouts:  counter(promMetricNames[timedoutConst]),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    promMetricNames[durationsConst],
+			Help:    "Realtime durations of calls",
+			Buckets: realtimeDurationBuckets,
+		}, labels),
+	}
+	registerer.MustRegister(listener.calls, listener.completed, listener.failed, listener.errors, listener.timeouts, listener.durations)
+	return listener
+}
+
+// BeforeCall counts a call when it starts
+func (listener *realtimeListener) BeforeCall(ctx context.Context, call *models.Call) error {
+	listener.calls.WithLabelValues(call.AppName, call.Path).Inc()
+	return nil
+}
+
+// AfterCall counts a call when it ends, according to its status, and records its duration
+// A call that timed out is counted as both a timeout and a failure, and any other unsuccessful call as both an error and a failure
+// A call that was cancelled, because the client went away or the Fn server is shutting down, did not fail, so it is
+// not counted as an error or a failure, and since it did not complete it is not counted as completed or given a duration
+func (listener *realtimeListener) AfterCall(ctx context.Context, call *models.Call) error {
+	switch call.Status {
+	case callStatusCancelled:
+		return nil
+	case callStatusSuccess:
+		listener.completed.WithLabelValues(call.AppName, call.Path).Inc()
+	case callStatusTimeout:
+		listener.timeouts.WithLabelValues(call.AppName, call.Path).Inc()
+		listener.failed.WithLabelValues(call.AppName, call.Path).Inc()
+	default:
+		listener.errors.WithLabelValues(call.AppName, call.Path).Inc()
+		listener.failed.WithLabelValues(call.AppName, call.Path).Inc()
+	}
+	if duration, ok := callDuration(call); ok {
+		listener.durations.WithLabelValues(call.AppName, call.Path).Observe(duration.Seconds())
+	}
+	return nil
+}
+
+// Return the time that the specified call took to run, and whether it is known
+// A call that has not been marked as completed is assumed to have completed now
+func callDuration(call *models.Call) (time.Duration, bool) {
+	startedAt := time.Time(call.StartedAt)
+	if startedAt.IsZero() {
+		return 0, false
+	}
+	completedAt := time.Time(call.CompletedAt)
+	if completedAt.IsZero() {
+		completedAt = time.Now()
+	}
+	return completedAt.Sub(startedAt), true
+}
+
+// Return the backend from which the statistics requested with the specified parameters are obtained
+func (params *queryParams) backend() (queryBackend, error) {
+	if !params.realtime {
+		return statisticsBackend, nil
+	}
+	if realtimeBackend == nil {
+		return nil, errors.New("realtime statistics are not available because the call listener is not registered")
+	}
+	return realtimeBackend, nil
+}
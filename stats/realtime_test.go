@@ -0,0 +1,71 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/fnproject/fn/api/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Replace realtimeBackend with an embedded backend that gathers the metrics of a new realtime listener
+// for the duration of a test, returning the listener, the backend and a function that restores realtimeBackend
+func useRealtimeBackend() (*realtimeListener, *embeddedBackend, func()) {
+	savedBackend := realtimeBackend
+	registry := prometheus.NewRegistry()
+	listener := newRealtimeListener(registry)
+	backend := newEmbeddedBackend(registry, 10, nil)
+	realtimeBackend = backend
+	return listener, backend, func() { realtimeBackend = savedBackend }
+}
+
+func TestRealtimeCurrentStatistics(t *testing.T) {
+
+	listener, backend, restore := useRealtimeBackend()
+	defer restore()
+
+	ctx := context.Background()
+	for _, status := range []string{callStatusSuccess, callStatusSuccess, callStatusTimeout, "error", callStatusCancelled} {
+		call := &models.Call{AppName: "myapp", Path: "/hello", Status: status}
+		assertNoError(t, "calling BeforeCall", listener.BeforeCall(ctx, call))
+		assertNoError(t, "calling AfterCall", listener.AfterCall(ctx, call))
+	}
+	listener.BeforeCall(ctx, &models.Call{AppName: "myapp", Path: "/goodbye"})
+	backend.gather(time.Unix(1500000000, 0))
+
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/routes/hello/stats/current?realtime=true&metrics=calls,completed,errors,timeouts,failed&endtime=1500000000", nil)
+	var response currentMetricsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handleCurrent(r, "myapp", "/hello"), &response))
+
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+	// the cancelled call is counted as a call, but not as completed or failed
+	expected := map[string]float64{"calls": 5, "completed": 2, "errors": 1, "timeouts": 1, "failed": 2}
+	for key, value := range expected {
+		if response.Data[key] == nil || *response.Data[key] != value {
+			t.Errorf("Expected %v to be %v, got %v", key, value, response.Data[key])
+		}
+	}
+}
+
+func TestRealtimeWithoutCallListener(t *testing.T) {
+
+	savedBackend := realtimeBackend
+	defer func() { realtimeBackend = savedBackend }()
+	realtimeBackend = nil
+
+	r := httptest.NewRequest("GET", "/stats?realtime=true", nil)
+	var response errorResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handle(r, "", ""), &response))
+	assertStringsEqual(t, "status", STATS_STATUS_ERROR, response.Status)
+}
+
+func TestRealtimeWindow(t *testing.T) {
+
+	// a window that is too short for statistics scraped by Prometheus is long enough for realtime statistics
+	if err := validateWindow(10*time.Second, false); err == nil {
+		t.Errorf("Expected an error for a window of 10s")
+	}
+	assertNoError(t, "validating a realtime window of 10s", validateWindow(10*time.Second, true))
+}
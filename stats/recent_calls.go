@@ -0,0 +1,186 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fnproject/fn/api/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The recent calls API returns the most recent calls to a route made to this Fn server,
+// which are recorded by a CallListener as each call ends, so that the calls behind a spike in errors can be seen
+
+type routeRecentCallsHandler struct{}
+
+func (h *routeRecentCallsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, app *models.App, route *models.Route) {
+	jsonData := handleRecentCalls(r, app.Name, route.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// the default number of calls held for each route
+const defaultRecentCalls = 100
+
+// the recent calls returned by the recent calls API, nil if the call listener has not been registered
+var recentCallsListener *recentCalls
+
+// The CallListener that holds the most recent calls to each route of each application
+type recentCalls struct {
+	capacity int // the number of calls held for each route
+	mutex    sync.Mutex
+	routes   map[routeKey]*callRing // protected by mutex
+}
+
+// Identifies a route of an application
+type routeKey struct {
+	appName string
+	path    string
+}
+
+// A single call that has ended
+type recentCall struct {
+	id          string
+	startTime   time.Time
+	duration    time.Duration
+	hasDuration bool   // whether the duration is known
+	outcome     string // the status of the call, such as success or timeout
+	callType    string // sync or async
+	err         string // the error message, if any
+}
+
+// A ring buffer holding the most recent calls to a route, in the order in which they ended
+type callRing struct {
+	calls []recentCall
+	start int // the index of the oldest call
+	count int
+}
+
+// Create a listener that holds the specified number of calls for each route
+func newRecentCalls(capacity int) *recentCalls {
+	return &recentCalls{capacity: capacity, routes: make(map[routeKey]*callRing)}
+}
+
+// BeforeCall does nothing, since calls are recorded when they end
+func (listener *recentCalls) BeforeCall(ctx context.Context, call *models.Call) error {
+	return nil
+}
+
+// AfterCall records a call when it ends
+// A call that never started, such as one that could not be scheduled, is recorded at the time it was created
+func (listener *recentCalls) AfterCall(ctx context.Context, call *models.Call) error {
+	startTime := time.Time(call.StartedAt)
+	if startTime.IsZero() {
+		startTime = time.Time(call.CreatedAt)
+	}
+	duration, hasDuration := callDuration(call)
+	listener.add(call.AppName, call.Path, recentCall{
+		id:          call.ID,
+		startTime:   startTime,
+		duration:    duration,
+		hasDuration: hasDuration,
+		outcome:     call.Status,
+		callType:    call.Type,
+		err:         call.Error,
+	})
+	return nil
+}
+
+// Add a call to the calls held for the specified route, replacing the oldest if the route already holds the maximum number
+func (listener *recentCalls) add(appName string, path string, call recentCall) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	key := routeKey{appName: appName, path: path}
+	ring := listener.routes[key]
+	if ring == nil {
+		ring = &callRing{calls: make([]recentCall, listener.capacity)}
+		listener.routes[key] = ring
+	}
+	ring.add(call)
+}
+
+// Return the calls held for the specified route that match the specified parameters, with the most recent first
+func (listener *recentCalls) find(appName string, path string, params *recentCallsQueryParams) []recentCall {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	ring := listener.routes[routeKey{appName: appName, path: path}]
+	if ring == nil {
+		return nil
+	}
+	var calls []recentCall
+	for i := ring.count - 1; i >= 0; i-- {
+		if call := ring.at(i); params.matches(call) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Add a call, replacing the oldest if the ring is full
+func (ring *callRing) add(call recentCall) {
+	if ring.count < len(ring.calls) {
+		ring.calls[(ring.start+ring.count)%len(ring.calls)] = call
+		ring.count++
+		return
+	}
+	ring.calls[ring.start] = call
+	ring.start = (ring.start + 1) % len(ring.calls)
+}
+
+// Return the call at the specified index, where 0 is the oldest
+func (ring *callRing) at(i int) recentCall {
+	return ring.calls[(ring.start+i)%len(ring.calls)]
+}
+
+// Return whether the specified call has one of the requested outcomes and started within the requested time range
+func (params *recentCallsQueryParams) matches(call recentCall) bool {
+	if params.outcomes != nil && !params.outcomes[call.outcome] {
+		return false
+	}
+	if !params.startTime.IsZero() && call.startTime.Before(params.startTime) {
+		return false
+	}
+	if !params.endTime.IsZero() && call.startTime.After(params.endTime) {
+		return false
+	}
+	return true
+}
+
+// Process the request and return the recent calls to the specified route as JSON
+func handleRecentCalls(r *http.Request, appName string, routeName string) []byte {
+
+	if recentCallsListener == nil {
+		return getErrorAsJSON(errors.New("recent calls are not available because the call listener is not registered"))
+	}
+	params, err := getRecentCallsQueryParams(r)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+
+	calls := recentCallsListener.find(appName, routeName, params)
+	responseStruct := new(recentCallsResponse)
+	responseStruct.Status = STATS_STATUS_SUCCESS
+	responseStruct.Calls = make([]recentCallJSON, 0, len(calls))
+	for _, call := range calls {
+		callJSON := recentCallJSON{
+			ID:        call.id,
+			StartTime: call.startTime.Format(prometheusTimeFormat),
+			Outcome:   call.outcome,
+			Type:      call.callType,
+			Error:     call.err,
+		}
+		if call.hasDuration {
+			duration := call.duration.Seconds()
+			callJSON.Duration = &duration
+		}
+		responseStruct.Calls = append(responseStruct.Calls, callJSON)
+	}
+
+	jsonData, err := json.Marshal(responseStruct)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	return jsonData
+}
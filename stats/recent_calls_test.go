@@ -0,0 +1,103 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/fnproject/fn/api/models"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replace recentCallsListener with a new listener that holds the specified number of calls for each route
+// for the duration of a test, returning the listener and a function that restores recentCallsListener
+func useRecentCalls(capacity int) (*recentCalls, func()) {
+	savedListener := recentCallsListener
+	recentCallsListener = newRecentCalls(capacity)
+	return recentCallsListener, func() { recentCallsListener = savedListener }
+}
+
+// Return the IDs of the calls in the response to the specified request for the recent calls to /hello in myapp
+func recentCallIDs(t *testing.T, query string) string {
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/routes/hello/stats/calls?"+query, nil)
+	var response recentCallsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handleRecentCalls(r, "myapp", "/hello"), &response))
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+	var ids []string
+	for _, call := range response.Calls {
+		ids = append(ids, call.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestRecentCalls(t *testing.T) {
+
+	listener, restore := useRecentCalls(4)
+	defer restore()
+
+	start := time.Unix(1500000000, 0)
+	outcomes := []string{callStatusSuccess, callStatusError, callStatusSuccess, callStatusTimeout, callStatusError, callStatusSuccess}
+	for i, outcome := range outcomes {
+		id := string('a' + rune(i))
+		listener.add("myapp", "/hello", recentCall{id: id, startTime: start.Add(time.Duration(i) * time.Second), duration: time.Second, hasDuration: true, outcome: outcome, callType: "sync"})
+	}
+	listener.add("myapp", "/goodbye", recentCall{id: "x", startTime: start, outcome: callStatusError})
+
+	// only the four most recent calls are held, and the most recent is returned first
+	assertStringsEqual(t, "all calls", "f,e,d,c", recentCallIDs(t, ""))
+	assertStringsEqual(t, "unsuccessful calls", "e,d", recentCallIDs(t, "outcome=error,timeout"))
+	assertStringsEqual(t, "unsuccessful calls with spaces", "e,d", recentCallIDs(t, "outcome=error,%20timeout"))
+	assertStringsEqual(t, "calls in time range", "e,d", recentCallIDs(t, "starttime=1500000003&endtime=1500000004"))
+	assertStringsEqual(t, "calls after starttime", "f,e", recentCallIDs(t, "starttime=1500000004"))
+}
+
+func TestRecentCallsListener(t *testing.T) {
+
+	listener, restore := useRecentCalls(10)
+	defer restore()
+
+	call := &models.Call{ID: "call1", AppName: "myapp", Path: "/hello", Type: "async", Status: callStatusError, Error: "container exited"}
+	assertNoError(t, "calling BeforeCall", listener.BeforeCall(context.Background(), call))
+	assertNoError(t, "calling AfterCall", listener.AfterCall(context.Background(), call))
+
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/routes/hello/stats/calls", nil)
+	var response recentCallsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handleRecentCalls(r, "myapp", "/hello"), &response))
+	assertIntsEqual(t, "Number of calls", 1, len(response.Calls))
+	assertStringsEqual(t, "type", "async", response.Calls[0].Type)
+	assertStringsEqual(t, "outcome", callStatusError, response.Calls[0].Outcome)
+	assertStringsEqual(t, "error", "container exited", response.Calls[0].Error)
+	if response.Calls[0].Duration != nil {
+		t.Errorf("Expected no duration for a call that never started, got %v", *response.Calls[0].Duration)
+	}
+}
+
+func TestRecentCallsHandlerWritesErrorsUnchanged(t *testing.T) {
+
+	listener, restore := useRecentCalls(10)
+	defer restore()
+	listener.add("myapp", "/hello", recentCall{id: "a", startTime: time.Unix(1500000000, 0), outcome: callStatusError, err: "disk 100% full"})
+
+	// an error containing % must not be treated as part of a format string
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/routes/hello/stats/calls", nil)
+	(&routeRecentCallsHandler{}).ServeHTTP(w, r, &models.App{Name: "myapp"}, &models.Route{AppName: "myapp", Path: "/hello"})
+	var response recentCallsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(w.Body.Bytes(), &response))
+	assertIntsEqual(t, "Number of calls", 1, len(response.Calls))
+	assertStringsEqual(t, "error", "disk 100% full", response.Calls[0].Error)
+}
+
+func TestRecentCallsParameters(t *testing.T) {
+
+	_, restore := useRecentCalls(10)
+	defer restore()
+
+	for _, query := range []string{"outcome=failed", "starttime=yesterday", "starttime=1500000004&endtime=1500000003"} {
+		r := httptest.NewRequest("GET", "/v1/apps/myapp/routes/hello/stats/calls?"+query, nil)
+		var response errorResponse
+		assertNoError(t, "parsing response", json.Unmarshal(handleRecentCalls(r, "myapp", "/hello"), &response))
+		assertStringsEqual(t, "status for "+query, STATS_STATUS_ERROR, response.Status)
+	}
+}
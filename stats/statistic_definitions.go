@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strconv"
+)
+
+// Additional statistics may be declared in a YAML or JSON file, specified using EnvDefinitions, such as
+//
+// statistics:
+// - key: cold_starts
+//   metric: fn_cold_starts
+//   kind: counter
+//
+// These are loaded when the extension is set up and are returned by the statistics APIs alongside the built-in statistics
+
+// kinds of Prometheus metric that may be used in a statistic definition
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+	kindRatio     = "ratio" // the ratio of the rate of increase of a counter to that of fn_calls, which cannot be declared in a file
+)
+
+// ways in which the values of a metric from different applications, routes and Fn servers may be combined
+const (
+	aggregationSum  = "sum"
+	aggregationAvg  = "avg"
+	aggregationMin  = "min"
+	aggregationMax  = "max"
+	aggregationMean = "mean" // the mean of the observations in a histogram, calculated over the window
+)
+
+// the aggregations allowed for each kind of metric, the first of which is the default
+var aggregationsByKind = map[string][]string{
+	kindCounter:   {aggregationSum},
+	kindGauge:     {aggregationSum, aggregationAvg, aggregationMin, aggregationMax},
+	kindHistogram: {aggregationMean},
+}
+
+// The contents of a statistic definitions file
+type statisticDefinitions struct {
+	Statistics []statisticDefinition `yaml:"statistics"`
+}
+
+// The definition of a single additional statistic
+type statisticDefinition struct {
+	Key         string `yaml:"key"`         // the key that will hold this statistic in the returned JSON data structure
+	Metric      string `yaml:"metric"`      // the name of the Prometheus metric
+	Kind        string `yaml:"kind"`        // one of kindCounter, kindGauge or kindHistogram
+	Aggregation string `yaml:"aggregation"` // optional, defaults to the first of aggregationsByKind for the kind
+}
+
+// Read and validate the statistic definitions in the specified file
+func readStatisticDefinitions(filename string) ([]statisticDefinition, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatisticDefinitions(data)
+}
+
+// Parse and validate statistic definitions, which may be in YAML or JSON (since JSON is a subset of YAML)
+// Returns an error if any definition is invalid, or if its key is already used by another statistic
+func parseStatisticDefinitions(data []byte) ([]statisticDefinition, error) {
+
+	var definitions statisticDefinitions
+	// unknown fields are rejected, so that a misspelt field is not silently ignored
+	if err := yaml.UnmarshalStrict(data, &definitions); err != nil {
+		return nil, errors.New("Unable to parse statistic definitions: " + err.Error())
+	}
+
+	usedJSONKeys := make(map[string]bool)
+	for i := range definitions.Statistics {
+		definition := &definitions.Statistics[i]
+		if err := definition.validate(); err != nil {
+			return nil, errors.New("Invalid statistic definition " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		if _, ok := registry.lookup(definition.Key); ok || usedJSONKeys[definition.Key] {
+			return nil, errors.New("Invalid statistic definition " + strconv.Itoa(i+1) + ": statistic " + definition.Key + " is already defined")
+		}
+		usedJSONKeys[definition.Key] = true
+	}
+	return definitions.Statistics, nil
+}
+
+// Check that the definition is valid, setting the default aggregation if none was specified
+func (definition *statisticDefinition) validate() error {
+	aggregations, ok := aggregationsByKind[definition.Kind]
+	if !ok {
+		return errors.New("kind " + strconv.Quote(definition.Kind) + " is not one of " + kindCounter + ", " + kindGauge + " or " + kindHistogram)
+	}
+	if definition.Aggregation == "" {
+		definition.Aggregation = aggregations[0]
+	} else if definition.Kind != kindGauge && definition.Aggregation != aggregations[0] {
+		return errors.New("aggregation " + strconv.Quote(definition.Aggregation) + " is not supported for a " + definition.Kind + ", use " + aggregations[0])
+	}
+	return definition.statistic().validate()
+}
+
+// Return the statistic declared by this definition
+func (definition *statisticDefinition) statistic() Statistic {
+	query := QueryStrategy{kind: definition.Kind}
+	if definition.Kind == kindGauge {
+		query.aggregation = definition.Aggregation
+	}
+	return Statistic{Key: definition.Key, Metric: definition.Metric, Query: query}
+}
+
+// Add the specified statistics to those returned by the statistics APIs
+// Returns an error if any of them has been registered since the definitions were read
+func addStatisticDefinitions(definitions []statisticDefinition) error {
+	for _, definition := range definitions {
+		if err := RegisterStatistic(definition.statistic()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
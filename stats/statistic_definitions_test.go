@@ -0,0 +1,64 @@
+package stats
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatisticDefinitions(t *testing.T) {
+
+	yamlData := `
+statistics:
+- key: cold_starts
+  metric: fn_cold_starts
+  kind: counter
+- key: max_memory
+  metric: fn_memory_bytes
+  kind: gauge
+  aggregation: max
+`
+	jsonData := `{"statistics": [
+		{"key": "cold_starts", "metric": "fn_cold_starts", "kind": "counter"},
+		{"key": "max_memory", "metric": "fn_memory_bytes", "kind": "gauge", "aggregation": "max"}
+	]}`
+
+	for _, data := range []string{yamlData, jsonData} {
+		definitions, err := parseStatisticDefinitions([]byte(data))
+		assertNoError(t, "parseStatisticDefinitions", err)
+		assertIntsEqual(t, "Number of definitions", 2, len(definitions))
+		assertStringsEqual(t, "Key", "cold_starts", definitions[0].Key)
+		assertStringsEqual(t, "Metric", "fn_cold_starts", definitions[0].Metric)
+		assertStringsEqual(t, "Default aggregation", aggregationSum, definitions[0].Aggregation)
+		assertStringsEqual(t, "Aggregation", aggregationMax, definitions[1].Aggregation)
+	}
+}
+
+func TestParseInvalidStatisticDefinitions(t *testing.T) {
+
+	invalidData := map[string]string{
+		"unknown field":           `{"statistics": [{"key": "x", "metric": "fn_x", "kind": "counter", "agregation": "sum"}]}`,
+		"invalid key":             `{"statistics": [{"key": "x-y", "metric": "fn_x", "kind": "counter"}]}`,
+		"invalid metric":          `{"statistics": [{"key": "x", "metric": "fn_x{a=\"b\"}", "kind": "counter"}]}`,
+		"unknown kind":            `{"statistics": [{"key": "x", "metric": "fn_x", "kind": "summary"}]}`,
+		"unsupported aggregation": `{"statistics": [{"key": "x", "metric": "fn_x", "kind": "counter", "aggregation": "max"}]}`,
+		"built-in key":            `{"statistics": [{"key": "calls", "metric": "fn_x", "kind": "counter"}]}`,
+		"duplicate key":           `{"statistics": [{"key": "x", "metric": "fn_x", "kind": "counter"}, {"key": "x", "metric": "fn_y", "kind": "gauge"}]}`,
+	}
+
+	for description, data := range invalidData {
+		_, err := parseStatisticDefinitions([]byte(data))
+		if err == nil {
+			t.Errorf("Expected an error for statistic definitions with %s", description)
+		}
+	}
+}
+
+func TestQueryBuilderForAggregation(t *testing.T) {
+	scope := &queryScope{appName: "myapp", groupByLabel: instanceLabel, window: time.Minute, step: time.Minute}
+	query := queryBuilderForAggregation(aggregationMax)("fn_memory_bytes", scope)
+	assertStringsEqual(t, "Query", `max(fn_memory_bytes{fn_appname="myapp"})by(instance)`, query)
+	if strings.Contains(query, " ") {
+		t.Errorf("Query %s contains a space", query)
+	}
+}
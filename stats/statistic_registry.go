@@ -0,0 +1,167 @@
+package stats
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Other Fn extensions may add their own statistics to those returned by the statistics APIs by calling RegisterStatistic
+// from their Setup function, such as
+//
+// err := stats.RegisterStatistic(stats.Statistic{Key: "auth_failures", Metric: "myext_auth_failures", Query: stats.CounterQuery()})
+
+// Statistic describes a statistic returned by the statistics APIs
+type Statistic struct {
+	Key    string        // the key that will hold this statistic in the returned JSON data structure
+	Metric string        // the name of the Prometheus metric from which this statistic is obtained
+	Query  QueryStrategy // how the Prometheus query for this statistic is built
+}
+
+// QueryStrategy determines how the Prometheus query for a statistic is built
+// Use CounterQuery, GaugeQuery, HistogramQuery or RatioQuery to obtain one
+type QueryStrategy struct {
+	kind        string // one of kindCounter, kindGauge, kindHistogram or kindRatio
+	aggregation string // the aggregation used for a gauge, empty for other kinds
+}
+
+// CounterQuery returns the strategy for a Prometheus counter, which is summed over all applications, routes and Fn servers
+// The statistic is returned as a cumulative count, or as a rate or increase if requested using the mode parameter
+func CounterQuery() QueryStrategy {
+	return QueryStrategy{kind: kindCounter}
+}
+
+// GaugeQuery returns the strategy for a Prometheus gauge, whose values from each application, route and Fn server
+// are combined using the specified aggregation, which must be "sum", "avg", "min" or "max"
+func GaugeQuery(aggregation string) QueryStrategy {
+	return QueryStrategy{kind: kindGauge, aggregation: aggregation}
+}
+
+// HistogramQuery returns the strategy for a Prometheus histogram, which is returned as the mean of its observations
+// calculated over a rolling window, in the same way as the durations statistic
+func HistogramQuery() QueryStrategy {
+	return QueryStrategy{kind: kindHistogram}
+}
+
+// RatioQuery returns the strategy for the ratio of the rate of increase of a Prometheus counter to the rate of increase of calls,
+// calculated over a rolling window, in the same way as the error_ratio statistic
+func RatioQuery() QueryStrategy {
+	return QueryStrategy{kind: kindRatio}
+}
+
+// Return the function that builds the Prometheus query for this strategy
+func (strategy QueryStrategy) queryBuilder() queryBuilderFunc {
+	switch strategy.kind {
+	case kindGauge:
+		return queryBuilderForAggregation(strategy.aggregation)
+	case kindHistogram:
+		return queryBuilderForHistograms
+	case kindRatio:
+		return queryBuilderForRatios
+	default:
+		return queryBuilderForCountersAndGauges
+	}
+}
+
+// Return whether the metric is a Prometheus counter, which can therefore be returned as a rate or increase
+func (strategy QueryStrategy) isCounter() bool {
+	return strategy.kind == kindCounter
+}
+
+// Check that the strategy was obtained from one of the functions above, with a supported aggregation
+func (strategy QueryStrategy) validate() error {
+	if strategy.kind == kindRatio {
+		return nil
+	}
+	aggregations, ok := aggregationsByKind[strategy.kind]
+	if !ok {
+		return errors.New("query strategy must be obtained using CounterQuery, GaugeQuery, HistogramQuery or RatioQuery")
+	}
+	if strategy.kind != kindGauge {
+		return nil
+	}
+	for _, aggregation := range aggregations {
+		if strategy.aggregation == aggregation {
+			return nil
+		}
+	}
+	return errors.New("aggregation " + strconv.Quote(strategy.aggregation) + " is not supported for a " + strategy.kind + ", use one of " + strings.Join(aggregations, ", "))
+}
+
+var statisticKeyRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var promMetricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Check that the statistic has a valid key, metric name and query strategy
+func (statistic Statistic) validate() error {
+	if !statisticKeyRegexp.MatchString(statistic.Key) {
+		return errors.New("key " + strconv.Quote(statistic.Key) + " must contain only letters, digits and underscores, and must not start with a digit")
+	}
+	if !promMetricNameRegexp.MatchString(statistic.Metric) {
+		return errors.New("metric " + strconv.Quote(statistic.Metric) + " is not a valid Prometheus metric name")
+	}
+	return statistic.Query.validate()
+}
+
+// The statistics returned by the statistics APIs
+// Statistics may be registered at any time, including while requests are being handled
+type statisticRegistry struct {
+	mutex      sync.RWMutex
+	statistics map[string]Statistic // keyed by the key that will hold the statistic in the returned JSON data structure
+}
+
+// the registry of all statistics, which initially contains the built-in statistics
+var registry = newStatisticRegistry()
+
+// Return a registry containing the built-in statistics
+// These are added without being validated, since they are known to be valid (which is checked by TestBuiltinStatisticsAreValid)
+func newStatisticRegistry() *statisticRegistry {
+	registry := &statisticRegistry{statistics: make(map[string]Statistic)}
+	for _, statistic := range builtinStatistics {
+		registry.statistics[statistic.Key] = statistic
+	}
+	return registry
+}
+
+// RegisterStatistic adds the specified statistic to those returned by the statistics APIs
+// Returns an error if the statistic is invalid, or if its key is already used by another statistic
+func RegisterStatistic(statistic Statistic) error {
+	return registry.register(statistic)
+}
+
+// Add the specified statistic to the registry
+// Returns an error if the statistic is invalid, or if its key is already used by another statistic
+func (registry *statisticRegistry) register(statistic Statistic) error {
+	if err := statistic.validate(); err != nil {
+		return errors.New("Invalid statistic " + statistic.Key + ": " + err.Error())
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.statistics[statistic.Key]; ok {
+		return errors.New("Invalid statistic " + statistic.Key + ": statistic " + statistic.Key + " is already defined")
+	}
+	registry.statistics[statistic.Key] = statistic
+	return nil
+}
+
+// Return the statistic with the specified key, and whether it was found
+func (registry *statisticRegistry) lookup(jsonKey string) (Statistic, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	statistic, ok := registry.statistics[jsonKey]
+	return statistic, ok
+}
+
+// Return all the registered statistics, sorted by key
+func (registry *statisticRegistry) all() []Statistic {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	statistics := make([]Statistic, 0, len(registry.statistics))
+	for _, statistic := range registry.statistics {
+		statistics = append(statistics, statistic)
+	}
+	sort.Slice(statistics, func(i, j int) bool { return statistics[i].Key < statistics[j].Key })
+	return statistics
+}
@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRegisterStatistic(t *testing.T) {
+
+	testRegistry := newStatisticRegistry()
+	statistic := Statistic{Key: "auth_failures", Metric: "myext_auth_failures", Query: CounterQuery()}
+	assertNoError(t, "registering "+statistic.Key, testRegistry.register(statistic))
+
+	registeredStatistic, ok := testRegistry.lookup(statistic.Key)
+	if !ok {
+		t.Fatalf("Statistic %s was not found after being registered", statistic.Key)
+	}
+	assertStringsEqual(t, "Metric", statistic.Metric, registeredStatistic.Metric)
+	if !registeredStatistic.Query.isCounter() {
+		t.Errorf("Statistic %s should be a counter", statistic.Key)
+	}
+	assertIntsEqual(t, "Number of statistics", len(builtinStatistics)+1, len(testRegistry.all()))
+
+	// the global registry must not have been changed
+	if _, ok := registry.lookup(statistic.Key); ok {
+		t.Errorf("Statistic %s should not be in the global registry", statistic.Key)
+	}
+}
+
+func TestBuiltinStatisticsAreValid(t *testing.T) {
+
+	testRegistry := &statisticRegistry{statistics: make(map[string]Statistic)}
+	for _, statistic := range builtinStatistics {
+		assertNoError(t, "registering built-in statistic "+statistic.Key, testRegistry.register(statistic))
+	}
+}
+
+func TestRegisterInvalidStatistic(t *testing.T) {
+
+	testRegistry := newStatisticRegistry()
+	invalidStatistics := map[string]Statistic{
+		"built-in key":            {Key: "calls", Metric: "myext_calls", Query: CounterQuery()},
+		"invalid key":             {Key: "auth-failures", Metric: "myext_auth_failures", Query: CounterQuery()},
+		"invalid metric":          {Key: "auth_failures", Metric: "myext auth failures", Query: CounterQuery()},
+		"zero query strategy":     {Key: "auth_failures", Metric: "myext_auth_failures"},
+		"unsupported aggregation": {Key: "auth_failures", Metric: "myext_auth_failures", Query: GaugeQuery("median")},
+	}
+
+	for description, statistic := range invalidStatistics {
+		if err := testRegistry.register(statistic); err == nil {
+			t.Errorf("Expected an error when registering a statistic with %s", description)
+		}
+	}
+	assertIntsEqual(t, "Number of statistics", len(builtinStatistics), len(testRegistry.all()))
+}
+
+func TestRegisterStatisticConcurrently(t *testing.T) {
+
+	testRegistry := newStatisticRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "statistic_" + strconv.Itoa(i)
+			if err := testRegistry.register(Statistic{Key: key, Metric: "myext_" + key, Query: GaugeQuery(aggregationMax)}); err != nil {
+				t.Errorf("Registering %s FAILED due to error: %s", key, err)
+			}
+			testRegistry.all()
+			testRegistry.lookup(key)
+		}(i)
+	}
+	wg.Wait()
+	assertIntsEqual(t, "Number of statistics", len(builtinStatistics)+20, len(testRegistry.all()))
+}
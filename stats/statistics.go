@@ -1,68 +1,201 @@
 package stats
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/fnproject/ext-statsapi/fncommon"
 	"github.com/fnproject/fn/api/models"
 	"github.com/fnproject/fn/fnext"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
-	EnvPromHost = "FN_EXT_STATS_PROM_HOST"
-	EnvPromPort = "FN_EXT_STATS_PROM_PORT"
+	EnvBackend                   = "FN_EXT_STATS_BACKEND"
+	EnvEmbeddedPoints            = "FN_EXT_STATS_EMBEDDED_POINTS"
+	EnvEmbeddedDir               = "FN_EXT_STATS_EMBEDDED_DIR"
+	EnvEmbeddedRetention         = "FN_EXT_STATS_EMBEDDED_RETENTION"
+	EnvRealtimeInterval          = "FN_EXT_STATS_REALTIME_INTERVAL"
+	EnvRealtimePoints            = "FN_EXT_STATS_REALTIME_POINTS"
+	EnvRecentCalls               = "FN_EXT_STATS_RECENT_CALLS"
+	EnvPromHost                  = "FN_EXT_STATS_PROM_HOST"
+	EnvPromPort                  = "FN_EXT_STATS_PROM_PORT"
+	EnvPromURL                   = "FN_EXT_STATS_PROM_URL"
+	EnvPromUsername              = "FN_EXT_STATS_PROM_USERNAME"
+	EnvPromPassword              = "FN_EXT_STATS_PROM_PASSWORD"
+	EnvPromPasswordFile          = "FN_EXT_STATS_PROM_PASSWORD_FILE"
+	EnvPromBearerToken           = "FN_EXT_STATS_PROM_BEARER_TOKEN"
+	EnvPromBearerTokenFile       = "FN_EXT_STATS_PROM_BEARER_TOKEN_FILE"
+	EnvPromCAFile                = "FN_EXT_STATS_PROM_CA_FILE"
+	EnvPromCertFile              = "FN_EXT_STATS_PROM_CERT_FILE"
+	EnvPromKeyFile               = "FN_EXT_STATS_PROM_KEY_FILE"
+	EnvPromInsecureSkipVerify    = "FN_EXT_STATS_PROM_INSECURE_SKIP_VERIFY"
+	EnvMaxPoints                 = "FN_EXT_STATS_MAX_POINTS"
+	EnvWindow                    = "FN_EXT_STATS_WINDOW"
+	EnvScrapeInterval            = "FN_EXT_STATS_SCRAPE_INTERVAL"
+	EnvDefinitions               = "FN_EXT_STATS_DEFINITIONS"
+	EnvThanosDedup               = "FN_EXT_STATS_THANOS_DEDUP"
+	EnvThanosPartialResponse     = "FN_EXT_STATS_THANOS_PARTIAL_RESPONSE"
+	EnvThanosMaxSourceResolution = "FN_EXT_STATS_THANOS_MAX_SOURCE_RESOLUTION"
 )
 
-var promHost string
-var promPort string
+// the environment variables used to configure the default value of each Thanos parameter, keyed by parameter name
+var thanosParamEnvVars = map[string]string{
+	thanosDedup:               EnvThanosDedup,
+	thanosPartialResponse:     EnvThanosPartialResponse,
+	thanosMaxSourceResolution: EnvThanosMaxSourceResolution,
+}
+
+// values of EnvBackend, which determines where statistics are obtained
+const (
+	backendPrometheus = "prometheus" // an external Prometheus server (the default)
+	backendEmbedded   = "embedded"   // the metrics of this Fn server, gathered and held in memory
+)
+
+// the default maximum number of time-value pairs returned for each statistic, if not specified using the maxpoints parameter
+var defaultMaxPoints = prometheusMaxPoints
 
 type globalStatisticsHandler struct{}
 type appStatisticsHandler struct{}
 type routeStatisticsHandler struct{}
 
-func AddEndpoints(s fnext.ExtServer) {
+// AddEndpoints configures the statistics API using environment variables and adds its endpoints to the specified server
+// Returns an error if any of the environment variables is invalid, in which case no endpoints are added
+func AddEndpoints(s fnext.ExtServer) error {
 
-	promHost = fncommon.GetEnv(EnvPromHost, "localhost")
-	promPort = fncommon.GetEnv(EnvPromPort, "9090")
+	var err error
+	if defaultMaxPoints, err = fncommon.GetEnvIntOrError(EnvMaxPoints, prometheusMaxPoints); err != nil {
+		return err
+	}
+	if defaultMaxPoints < 1 || defaultMaxPoints > prometheusMaxPoints {
+		return errors.New(EnvMaxPoints + " must be between 1 and " + strconv.Itoa(prometheusMaxPoints))
+	}
+	if scrapeInterval, err = parseDuration(fncommon.GetEnv(EnvScrapeInterval, promDuration(scrapeInterval))); err != nil {
+		return errors.New(EnvScrapeInterval + ": " + err.Error())
+	}
+	if defaultWindow, err = parseDuration(fncommon.GetEnv(EnvWindow, promDuration(defaultWindow))); err != nil {
+		return errors.New(EnvWindow + ": " + err.Error())
+	}
+	if err = validateWindow(defaultWindow, false); err != nil {
+		return errors.New(EnvWindow + ": " + err.Error())
+	}
+	for name, envVar := range thanosParamEnvVars {
+		if value := fncommon.GetEnv(envVar, ""); value != "" {
+			value, err := parseThanosParam(name, value)
+			if err != nil {
+				return errors.New(envVar + ": " + err.Error())
+			}
+			defaultThanosParams.Set(name, value)
+		}
+	}
+	if definitionsFile := fncommon.GetEnv(EnvDefinitions, ""); definitionsFile != "" {
+		definitions, err := readStatisticDefinitions(definitionsFile)
+		if err == nil {
+			err = addStatisticDefinitions(definitions)
+		}
+		if err != nil {
+			return errors.New(EnvDefinitions + ": " + err.Error())
+		}
+	}
+	// the backend is configured last, so that it is not started if any of the other configuration is invalid
+	switch backend := fncommon.GetEnv(EnvBackend, backendPrometheus); backend {
+	case backendPrometheus:
+		promConnectionConfig, err := getPrometheusConnectionConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		if promConnection, err = newPrometheusConnection(promConnectionConfig); err != nil {
+			return err
+		}
+	case backendEmbedded:
+		// metrics are gathered every scrape interval, and the most recent points samples of each series are held in memory
+		points, err := fncommon.GetEnvIntOrError(EnvEmbeddedPoints, defaultEmbeddedPoints)
+		if err != nil {
+			return err
+		}
+		if points < 2 {
+			return errors.New(EnvEmbeddedPoints + " must be at least 2")
+		}
+		// optionally, samples are also written to disk and kept for the retention period
+		var store *diskStore
+		if dir := fncommon.GetEnv(EnvEmbeddedDir, ""); dir != "" {
+			retention, err := parseDuration(fncommon.GetEnv(EnvEmbeddedRetention, promDuration(defaultEmbeddedRetention)))
+			if err != nil {
+				return errors.New(EnvEmbeddedRetention + ": " + err.Error())
+			}
+			if retention <= 0 {
+				return errors.New(EnvEmbeddedRetention + " must be positive")
+			}
+			if store, err = openDiskStore(dir, retention); err != nil {
+				return errors.New(EnvEmbeddedDir + ": " + err.Error())
+			}
+		}
+		embedded := newEmbeddedBackend(prometheus.DefaultGatherer, points, store)
+		if store != nil {
+			if err := embedded.load(time.Now().Add(-time.Duration(points) * scrapeInterval)); err != nil {
+				return errors.New(EnvEmbeddedDir + ": " + err.Error())
+			}
+		}
+		go embedded.run(scrapeInterval)
+		statisticsBackend = embedded
+	default:
+		return errors.New(EnvBackend + " must be " + backendPrometheus + " or " + backendEmbedded)
+	}
 
 	s.AddEndpoint("GET", "/stats", &globalStatisticsHandler{})
 	s.AddEndpoint("GET", "/statistics", &globalStatisticsHandler{})
+	s.AddEndpoint("GET", "/stats/top", &globalTopStatisticsHandler{})
+	s.AddEndpoint("GET", "/statistics/top", &globalTopStatisticsHandler{})
+	s.AddEndpoint("GET", "/stats/current", &globalCurrentStatisticsHandler{})
+	s.AddEndpoint("GET", "/statistics/current", &globalCurrentStatisticsHandler{})
 
 	// the following will be at /v1/apps/:app_name/stats
 	s.AddAppEndpoint("GET", "/stats", &appStatisticsHandler{})
 	s.AddAppEndpoint("GET", "/statistics", &appStatisticsHandler{})
+	s.AddAppEndpoint("GET", "/stats/top", &appTopStatisticsHandler{})
+	s.AddAppEndpoint("GET", "/statistics/top", &appTopStatisticsHandler{})
+	s.AddAppEndpoint("GET", "/stats/current", &appCurrentStatisticsHandler{})
+	s.AddAppEndpoint("GET", "/statistics/current", &appCurrentStatisticsHandler{})
 
 	// the following will be at /v1/apps/:app_name/routes/:route_name/stats
 	s.AddRouteEndpoint("GET", "/stats", &routeStatisticsHandler{})
 	s.AddRouteEndpoint("GET", "/statistics", &routeStatisticsHandler{})
+	s.AddRouteEndpoint("GET", "/stats/current", &routeCurrentStatisticsHandler{})
+	s.AddRouteEndpoint("GET", "/statistics/current", &routeCurrentStatisticsHandler{})
+	s.AddRouteEndpoint("GET", "/stats/calls", &routeRecentCallsHandler{})
+	s.AddRouteEndpoint("GET", "/statistics/calls", &routeRecentCallsHandler{})
+	return nil
 }
 
 func (h *globalStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	jsonData := handle(r, "", "")
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(jsonData))
+	w.Write(jsonData)
 }
 
 func (h *appStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, app *models.App) {
 	jsonData := handle(r, app.Name, "")
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(jsonData))
+	w.Write(jsonData)
 }
 
 func (h *routeStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, app *models.App, route *models.Route) {
 	jsonData := handle(r, app.Name, route.Path)
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(jsonData))
+	w.Write(jsonData)
 }
 
-// these constants represent the various types of statistic returned by this API
-// If you add a new type of statistic you must also
-// (0) add a new entry to the map jsonKeys below
-// (1) add new entries to the maps promMetricNames in build_prometheus_request.go
-// (2) update the map queryBuilders (in build_prometheus_request.go)
-//     with the name of the appropriate query builder for this metric type
-//     this is essentially a case of specifying whether the metric is a histogram or a counter/gauge
+// these constants represent the various types of built-in statistic returned by this API
+// If you add a new type of built-in statistic you must also
+// (0) add a new entry to the map builtinStatistics below, specifying the appropriate query strategy for the metric
+// (1) add a new entry to the map promMetricNames in build_prometheus_request.go
+// Other Fn extensions can add statistics without changing this code by calling RegisterStatistic (see statistic_registry.go),
+// and an operator can declare additional statistics in a file (see statistic_definitions.go)
 const (
 	completedConst = iota
 	failedConst    = iota
@@ -72,47 +205,136 @@ const (
 	timedoutConst  = iota
 	queuedConst    = iota // used only in tests
 	runningConst   = iota // used only in tests
+	// the following are derived from the ratio of two counters
+	errorRatioConst   = iota
+	timeoutRatioConst = iota
+	successRatioConst = iota
 )
 
 // in this map, the key is the constant for the type of statistic and
-// the corresponding value is the name of the key that will hold this type of statistic in the returned JSON data structure
+// the corresponding value describes the statistic, including the name of the key that will hold it in the returned JSON data structure
+// these are added to the registry of statistics when the package is initialised
 // see comment above for information on adding a new type of statistic
-var jsonKeys = map[int]string{
-	completedConst: "completed",
-	failedConst:    "failed",
-	durationsConst: "durations",
-	callsConst:     "calls",
-	errorsConst:    "errors",
-	timedoutConst:  "timeouts",
+var builtinStatistics = map[int]Statistic{
+	completedConst:    {Key: "completed", Metric: promMetricNames[completedConst], Query: CounterQuery()},
+	failedConst:       {Key: "failed", Metric: promMetricNames[failedConst], Query: CounterQuery()},
+	durationsConst:    {Key: "durations", Metric: promMetricNames[durationsConst], Query: HistogramQuery()},
+	callsConst:        {Key: "calls", Metric: promMetricNames[callsConst], Query: CounterQuery()},
+	errorsConst:       {Key: "errors", Metric: promMetricNames[errorsConst], Query: CounterQuery()},
+	timedoutConst:     {Key: "timeouts", Metric: promMetricNames[timedoutConst], Query: CounterQuery()},
+	errorRatioConst:   {Key: "error_ratio", Metric: promMetricNames[errorRatioConst], Query: RatioQuery()},
+	timeoutRatioConst: {Key: "timeout_ratio", Metric: promMetricNames[timeoutRatioConst], Query: RatioQuery()},
+	successRatioConst: {Key: "success_ratio", Metric: promMetricNames[successRatioConst], Query: RatioQuery()},
 }
 
 var appLabel = "fn_appname"
 var routeLabel = "fn_path"
+var instanceLabel = "instance" // added by Prometheus to identify the Fn server from which a metric was scraped
 
 // Process the request and return the requested data as JSON
 func handle(r *http.Request, appName string, routeName string) []byte {
 
 	// parse query params and provide default values if needed
-	startTimeString, endTimeString, stepString, err := getQueryParams(r)
+	params, err := getQueryParams(r)
 	if err != nil {
 		return getErrorAsJSON(err)
 	}
 
+	// work out which label, if any, the results should be grouped by
+	groupByLabel, err := getGroupByLabel(params.groupBy, appName, routeName)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	if groupByLabel != "" && params.summary {
+		return getErrorAsJSON(errors.New("summary is not supported when groupby is specified"))
+	}
+
 	// create a struct that will contain our response prior to conversion to JSONs
 	responseStruct := new(metricsResponse)
 	responseStruct.Status = "success"
 	responseStruct.Data = make(map[string][]metricsTimeValuePair)
+	// if grouping, this will contain the data for each group, keyed by the value of the groupByLabel
+	groupedData := make(map[string]map[string][]metricsTimeValuePair)
 
-	// for each metric type, query Prometheus and populate the response struct
-	for metricType, jsonKey := range jsonKeys {
-		// construct the Prometheus request URL
-		url := buildPrometheusRequest(queryBuilders[metricType], promHost, promPort, metricType, appName, routeName, startTimeString, endTimeString, stepString)
-		// execute the Prometheus request and extract the array of time-value pairs from the response
-		metricDataArray, err := executePrometheusRequest(url)
-		if err != nil {
-			return getErrorAsJSON(err)
+	// the scope of the queries
+	scope := &queryScope{
+		appName:      appName,
+		routeName:    routeName,
+		instanceName: params.instance,
+		groupByLabel: groupByLabel,
+		window:       params.window,
+		step:         params.step,
+	}
+
+	// construct the query for each requested statistic and quantile, keyed by the name of the key that will hold it in the response
+	queries := params.statisticQueries(scope)
+
+	// the summary of a cumulative count includes its total increase over the requested period, which is obtained
+	// by a separate query so that a counter reset in any of the series that are summed is allowed for
+	increaseQueries := make(map[string]*statisticQuery)
+	if params.summary && params.endTime.After(params.startTime) {
+		increaseScope := *scope
+		increaseScope.step = params.endTime.Sub(params.startTime)
+		for jsonKey, query := range queries {
+			if query.isCumulative() {
+				increaseQuery := *query
+				increaseQuery.mode = modeIncrease
+				increaseQuery.scope = &increaseScope
+				increaseQueries[jsonKey] = &increaseQuery
+			}
+		}
+	}
+
+	backend, err := params.backend()
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+
+	// execute the queries concurrently and add the time-value pairs from the results to the response struct
+	// the queries are abandoned if the caller goes away or if they take too long
+	ctx, cancel := context.WithTimeout(r.Context(), prometheusTimeout)
+	defer cancel()
+	info, err := executeAndAddToResponse(ctx, backend, queries, responseStruct.Data, groupedData)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	increases, err := executeCurrentQueries(ctx, backend, increaseQueries)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	for _, result := range increases {
+		info.add(result.source, result.warnings)
+	}
+	responseStruct.Prometheus = info.sourceList()
+	responseStruct.Warnings = info.warningList()
+
+	if groupByLabel != "" {
+		// a group has no entry for a statistic if the backend had no values for it, so add an empty array
+		// this ensures every group contains the same keys
+		for _, groupData := range groupedData {
+			for jsonKey := range queries {
+				if groupData[jsonKey] == nil {
+					groupData[jsonKey] = make([]metricsTimeValuePair, 0)
+				}
+			}
+		}
+		responseStruct.Data = nil
+		responseStruct.setGroupedData(params.groupBy, groupedData)
+	}
+
+	if params.summary {
+		responseStruct.Summary = make(map[string]*metricsSummary)
+		for jsonKey, metricDataArray := range responseStruct.Data {
+			var increase *float64
+			if queries[jsonKey].isCumulative() {
+				// there is no value if there were too few samples to calculate an increase
+				increase = new(float64)
+				if result, ok := increases[jsonKey]; ok && result.value != nil {
+					*increase = *result.value
+				}
+			}
+			responseStruct.Summary[jsonKey] = summarise(metricDataArray, increase)
 		}
-		responseStruct.Data[jsonKey] = metricDataArray
 	}
 
 	// convert the response struct to JSON
@@ -123,6 +345,131 @@ func handle(r *http.Request, appName string, routeName string) []byte {
 	return jsonData
 }
 
+// Return a summary of the specified time-value pairs, or nil if there are none
+// If increase is not nil the values are cumulative counts, and the summary includes increase as their total increase
+func summarise(metricDataArray []metricsTimeValuePair, increase *float64) *metricsSummary {
+
+	if len(metricDataArray) == 0 {
+		return nil
+	}
+
+	summary := &metricsSummary{
+		Min:  metricDataArray[0].Value,
+		Max:  metricDataArray[0].Value,
+		Last: metricDataArray[len(metricDataArray)-1].Value,
+	}
+	var total float64
+	for _, tvp := range metricDataArray {
+		total += tvp.Value
+		if tvp.Value < summary.Min {
+			summary.Min = tvp.Value
+		}
+		if tvp.Value > summary.Max {
+			summary.Max = tvp.Value
+		}
+	}
+	summary.Average = total / float64(len(metricDataArray))
+	summary.Increase = increase
+	return summary
+}
+
+// Execute the specified queries concurrently using the specified backend and add the resulting time-value pairs to data,
+// using the key of each query in queries
+// The results of grouped queries are instead added to groupedData, keyed by the value of the groupByLabel
+// Returns information about the results, such as any warnings they contained
+func executeAndAddToResponse(ctx context.Context, backend queryBackend, queries map[string]*statisticQuery, data map[string][]metricsTimeValuePair, groupedData map[string]map[string][]metricsTimeValuePair) (*upstreamInfo, error) {
+
+	// protects data, groupedData and info
+	var mutex sync.Mutex
+	info := newUpstreamInfo()
+
+	var requests []func(context.Context) error
+	for jsonKey, query := range queries {
+		jsonKey, query := jsonKey, query
+		requests = append(requests, func(ctx context.Context) error {
+			result, err := backend.QueryRange(ctx, query)
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			info.add(result.source, result.warnings)
+			if query.scope.groupByLabel == "" {
+				data[jsonKey] = result.values
+				return nil
+			}
+			for labelValue, metricDataArray := range result.groupedValues {
+				if groupedData[labelValue] == nil {
+					groupedData[labelValue] = make(map[string][]metricsTimeValuePair)
+				}
+				groupedData[labelValue][jsonKey] = metricDataArray
+			}
+			return nil
+		})
+	}
+	if err := runConcurrently(ctx, requests); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Execute the specified queries concurrently using the specified backend and return the value of each of them
+// at the end of its range, keyed by the key of each query in queries
+func executeCurrentQueries(ctx context.Context, backend queryBackend, queries map[string]*statisticQuery) (map[string]*currentResult, error) {
+
+	var mutex sync.Mutex // protects results
+	results := make(map[string]*currentResult)
+	var requests []func(context.Context) error
+	for jsonKey, query := range queries {
+		jsonKey, query := jsonKey, query
+		requests = append(requests, func(ctx context.Context) error {
+			result, err := backend.QueryCurrent(ctx, query)
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[jsonKey] = result
+			return nil
+		})
+	}
+	if err := runConcurrently(ctx, requests); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Return the Prometheus label corresponding to the specified groupby parameter, or an empty string if not grouping
+// Returns an error if that grouping is not supported for the specified application and route
+func getGroupByLabel(groupBy string, appName string, routeName string) (string, error) {
+	switch groupBy {
+	case "":
+		return "", nil
+	case groupByApp:
+		if appName != "" {
+			return "", errors.New("groupby=" + groupByApp + " is only supported when requesting statistics for all applications")
+		}
+		return appLabel, nil
+	case groupByInstance:
+		return instanceLabel, nil
+	case groupByRoute:
+		if appName == "" || routeName != "" {
+			return "", errors.New("groupby=" + groupByRoute + " is only supported when requesting statistics for an application")
+		}
+		return routeLabel, nil
+	default:
+		return "", errors.New("groupby=" + groupBy + " is not supported")
+	}
+}
+
+// Return the key that will hold the specified quantile of a histogram statistic in the returned JSON data structure
+// For example the 0.99 quantile of durations will be returned as durations_p99
+// The percentile is rounded to four decimal places to avoid floating point noise in the key
+func quantileJSONKey(jsonKey string, quantile float64) string {
+	percentile := math.Floor(quantile*1e6+0.5) / 1e4
+	return jsonKey + "_p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+}
+
 func getErrorAsJSON(err error) []byte {
 	errorResponseStruc := new(errorResponse)
 	errorResponseStruc.Status = STATS_STATUS_ERROR
@@ -12,11 +12,74 @@ type errorResponse struct {
 }
 
 type metricsResponse struct {
-	Status string                            `json:"status"` // "success" (STATS_STATUS_SUCCESS)
-	Data   map[string][]metricsTimeValuePair `json:"data"`
+	Status     string                                       `json:"status"` // "success" (STATS_STATUS_SUCCESS)
+	Data       map[string][]metricsTimeValuePair            `json:"data,omitempty"`
+	Apps       map[string]map[string][]metricsTimeValuePair `json:"apps,omitempty"`       // only present if groupby=app, keyed by application name
+	Routes     map[string]map[string][]metricsTimeValuePair `json:"routes,omitempty"`     // only present if groupby=route, keyed by route path
+	Instances  map[string]map[string][]metricsTimeValuePair `json:"instances,omitempty"`  // only present if groupby=instance, keyed by the Prometheus instance label
+	Summary    map[string]*metricsSummary                   `json:"summary,omitempty"`    // only present if summary=true, a value is null if there is no data
+	Prometheus []string                                     `json:"prometheus,omitempty"` // the base URL of each Prometheus server that provided the data
+	Warnings   []string                                     `json:"warnings,omitempty"`   // any warnings returned by Prometheus, such as those from Thanos if data may be missing
+}
+
+type metricsSummary struct {
+	Increase *float64 `json:"increase,omitempty"` // only present for statistics that are cumulative counts
+	Min      float64  `json:"min"`
+	Max      float64  `json:"max"`
+	Average  float64  `json:"average"`
+	Last     float64  `json:"last"`
+}
+
+type currentMetricsResponse struct {
+	Status     string              `json:"status"`               // "success" (STATS_STATUS_SUCCESS)
+	Time       int64               `json:"time"`                 // the time at which the statistics were evaluated
+	Data       map[string]*float64 `json:"data"`                 // a value is null if Prometheus has no value for that statistic
+	Prometheus []string            `json:"prometheus,omitempty"` // the base URL of each Prometheus server that provided the data
+	Warnings   []string            `json:"warnings,omitempty"`   // any warnings returned by Prometheus, such as those from Thanos if data may be missing
 }
 
 type metricsTimeValuePair struct {
 	Time  int64   `json:"time"`
 	Value float64 `json:"value"`
 }
+
+// Set the per-group statistics in the field of the response corresponding to the specified groupby parameter
+func (response *metricsResponse) setGroupedData(groupBy string, groupedData map[string]map[string][]metricsTimeValuePair) {
+	switch groupBy {
+	case groupByApp:
+		response.Apps = groupedData
+	case groupByRoute:
+		response.Routes = groupedData
+	case groupByInstance:
+		response.Instances = groupedData
+	}
+}
+
+type topResponse struct {
+	Status     string     `json:"status"`               // "success" (STATS_STATUS_SUCCESS)
+	By         string     `json:"by"`                   // the statistic used to rank the routes
+	Time       int64      `json:"time"`                 // the end of the time period over which the statistic was calculated
+	Top        []topRoute `json:"top"`                  // ordered with the highest value first
+	Prometheus []string   `json:"prometheus,omitempty"` // the base URL of the Prometheus server that provided the data
+	Warnings   []string   `json:"warnings,omitempty"`   // any warnings returned by Prometheus, such as those from Thanos if data may be missing
+}
+
+type topRoute struct {
+	App   string  `json:"app"`
+	Route string  `json:"route"`
+	Value float64 `json:"value"`
+}
+
+type recentCallsResponse struct {
+	Status string           `json:"status"` // "success" (STATS_STATUS_SUCCESS)
+	Calls  []recentCallJSON `json:"calls"`  // ordered with the most recent call first
+}
+
+type recentCallJSON struct {
+	ID        string   `json:"id"`
+	StartTime string   `json:"start_time"`      // formatted using prometheusTimeFormat
+	Duration  *float64 `json:"duration"`        // in seconds, null if the call never started
+	Outcome   string   `json:"outcome"`         // the status of the call: success, error, timeout or cancelled
+	Type      string   `json:"type"`            // sync or async
+	Error     string   `json:"error,omitempty"` // the error message, if the call did not succeed
+}
@@ -181,8 +181,12 @@ func verifyOnce(t *testing.T, response interface{}, expectedMetrics map[string]i
 
 	responseAsMap := response.(map[string]interface{})
 
-	// top level of JSON should be two keys, status and data
-	err = checkIntsEqual(t, "Number of keys in top-level JSON", 2, len(responseAsMap))
+	// top level of JSON should be three keys, status, data and prometheus
+	err = checkIntsEqual(t, "Number of keys in top-level JSON", 3, len(responseAsMap))
+	if err != nil {
+		return err
+	}
+	err = checkNotNil(t, "prometheus field should be present", responseAsMap["prometheus"])
 	if err != nil {
 		return err
 	}
@@ -204,29 +208,29 @@ func verifyOnce(t *testing.T, response interface{}, expectedMetrics map[string]i
 		return err
 	}
 	dataAsMap := responseAsMap["data"].(map[string]interface{})
-	err = checkIntsEqual(t, "Number of keys in data", 6, len(dataAsMap))
+	err = checkIntsEqual(t, "Number of keys in data", 9, len(dataAsMap))
 	if err != nil {
 		return err
 	}
 
 	// check the fields in the data array that correspond to basic metrics
-	err = checkMetricField(t, dataAsMap, jsonKeys[callsConst], expectedMetrics[promMetricNames[callsConst]])
+	err = checkMetricField(t, dataAsMap, builtinStatistics[callsConst].Key, expectedMetrics[promMetricNames[callsConst]])
 	if err != nil {
 		return err
 	}
-	err = checkMetricField(t, dataAsMap, jsonKeys[completedConst], expectedMetrics[promMetricNames[completedConst]])
+	err = checkMetricField(t, dataAsMap, builtinStatistics[completedConst].Key, expectedMetrics[promMetricNames[completedConst]])
 	if err != nil {
 		return err
 	}
-	err = checkMetricField(t, dataAsMap, jsonKeys[failedConst], expectedMetrics[promMetricNames[failedConst]])
+	err = checkMetricField(t, dataAsMap, builtinStatistics[failedConst].Key, expectedMetrics[promMetricNames[failedConst]])
 	if err != nil {
 		return err
 	}
-	err = checkMetricField(t, dataAsMap, jsonKeys[timedoutConst], expectedMetrics[promMetricNames[timedoutConst]])
+	err = checkMetricField(t, dataAsMap, builtinStatistics[timedoutConst].Key, expectedMetrics[promMetricNames[timedoutConst]])
 	if err != nil {
 		return err
 	}
-	err = checkMetricField(t, dataAsMap, jsonKeys[errorsConst], expectedMetrics[promMetricNames[errorsConst]])
+	err = checkMetricField(t, dataAsMap, builtinStatistics[errorsConst].Key, expectedMetrics[promMetricNames[errorsConst]])
 	if err != nil {
 		return err
 	}
@@ -254,6 +258,14 @@ func verifyOnce(t *testing.T, response interface{}, expectedMetrics map[string]i
 		}
 	}
 
+	// check the fields in the data array that correspond to derived ratios
+	for _, jsonKey := range []string{builtinStatistics[errorRatioConst].Key, builtinStatistics[timeoutRatioConst].Key, builtinStatistics[successRatioConst].Key} {
+		err = checkNotNil(t, jsonKey+" field should be present", dataAsMap[jsonKey])
+		if err != nil {
+			return err
+		}
+	}
+
 	// success!
 	return nil
 }
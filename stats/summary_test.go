@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// These tests check the summary of a statistic and do not require an Fn server or Prometheus
+
+// Return time-value pairs with the specified values, one second apart
+func timeValuePairs(values ...float64) []metricsTimeValuePair {
+	pairs := make([]metricsTimeValuePair, 0, len(values))
+	for i, value := range values {
+		pairs = append(pairs, metricsTimeValuePair{Time: int64(1500000000 + i), Value: value})
+	}
+	return pairs
+}
+
+func TestSummarise(t *testing.T) {
+
+	increase := 5.0
+	tests := []struct {
+		name     string
+		values   []float64
+		increase *float64 // the increase obtained from the backend, nil if the values are not cumulative counts
+		expected metricsSummary
+	}{
+		{"single value", []float64{4}, &increase, metricsSummary{Min: 4, Max: 4, Average: 4, Last: 4}},
+		{"cumulative count", []float64{1, 3, 3, 6}, &increase, metricsSummary{Min: 1, Max: 6, Average: 3.25, Last: 6}},
+		{"gauge", []float64{5, -1, 2}, nil, metricsSummary{Min: -1, Max: 5, Average: 2, Last: 2}},
+	}
+	for _, test := range tests {
+		summary := summarise(timeValuePairs(test.values...), test.increase)
+		if summary == nil {
+			t.Fatalf("Expected a summary of %s", test.name)
+		}
+		if summary.Min != test.expected.Min || summary.Max != test.expected.Max || summary.Average != test.expected.Average || summary.Last != test.expected.Last {
+			t.Errorf("Expected the summary of %s to be %+v, got %+v", test.name, test.expected, *summary)
+		}
+		if summary.Increase != test.increase {
+			t.Errorf("Expected an increase of %v in the summary of %s, got %v", test.increase, test.name, summary.Increase)
+		}
+	}
+
+	if summary := summarise(nil, &increase); summary != nil {
+		t.Errorf("Expected no summary of an empty array, got %+v", *summary)
+	}
+}
+
+func TestSummaryIncreaseWithCounterReset(t *testing.T) {
+
+	// the calls to /a increase steadily, but the Fn server handling /b restarts, resetting its counter
+	promRegistry := prometheus.NewRegistry()
+	calls := prometheus.NewCounterVec(prometheus.CounterOpts{Name: promMetricNames[callsConst]}, []string{appLabel, routeLabel})
+	promRegistry.MustRegister(calls)
+	backend := newEmbeddedBackend(promRegistry, 10, nil)
+	start := time.Unix(1500000000, 0)
+	calls.WithLabelValues("myapp", "/a").Add(9000)
+	calls.WithLabelValues("myapp", "/b").Add(1000)
+	backend.gather(start)
+	calls.WithLabelValues("myapp", "/a").Add(5)
+	calls.WithLabelValues("myapp", "/b").Add(5)
+	backend.gather(start.Add(15 * time.Second))
+	calls.WithLabelValues("myapp", "/a").Add(5)
+	calls.DeleteLabelValues("myapp", "/b")
+	calls.WithLabelValues("myapp", "/b").Add(5)
+	backend.gather(start.Add(30 * time.Second))
+	calls.WithLabelValues("myapp", "/a").Add(5)
+	backend.gather(start.Add(45 * time.Second))
+
+	savedBackend := statisticsBackend
+	defer func() { statisticsBackend = savedBackend }()
+	statisticsBackend = backend
+
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/stats?metrics=calls&starttime=1500000000&endtime=1500000045&step=15s&summary=true", nil)
+	var response metricsResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handle(r, "myapp", ""), &response))
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+
+	// the sum of the counters falls from 10010 to 9015, which is not a reset of either of them
+	summary := response.Summary["calls"]
+	if summary == nil || summary.Increase == nil {
+		t.Fatalf("Expected the summary of calls to have an increase, got %+v", summary)
+	}
+	assertFloatsEqual(t, "Last calls", 9020, summary.Last)
+	// /a increases by 10 and /b by 5 over the 30 seconds between the samples in the period,
+	// which is extrapolated to the whole period in the same way as the Prometheus increase function
+	assertFloatsEqual(t, "Increase in calls", 22.5, *summary.Increase)
+}
@@ -0,0 +1,113 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fnproject/fn/api/models"
+	"net/http"
+	"strconv"
+)
+
+// The top statistics API ranks routes by a chosen statistic, calculated over the requested time period,
+// and returns the routes with the highest values
+
+type globalTopStatisticsHandler struct{}
+type appTopStatisticsHandler struct{}
+
+func (h *globalTopStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	jsonData := handleTop(r, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+func (h *appTopStatisticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, app *models.App) {
+	jsonData := handleTop(r, app.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonData)
+}
+
+// Process the request and return the top routes as JSON
+// Routes are ranked using a single Prometheus query, so this is not supported by other backends (see QueryTop)
+func handleTop(r *http.Request, appName string) []byte {
+
+	// parse query params and provide default values if needed
+	params, err := getQueryParams(r)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	if params.realtime {
+		return getErrorAsJSON(errors.New("realtime is not supported when requesting top statistics"))
+	}
+	topParams, err := getTopQueryParams(r)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+
+	// the statistic is calculated over the whole of the requested time period
+	period := params.endTime.Sub(params.startTime)
+	if period <= 0 {
+		return getErrorAsJSON(errors.New("endtime (" + params.endTimeString + ") must be after starttime (" + params.startTimeString + ")"))
+	}
+
+	query := &topQuery{
+		by:          topParams.by,
+		quantile:    topParams.quantile,
+		n:           topParams.n,
+		scope:       &queryScope{appName: appName, instanceName: params.instance, window: period},
+		endTime:     params.endTime,
+		extraParams: params.thanosParams,
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), prometheusTimeout)
+	defer cancel()
+	result, err := statisticsBackend.QueryTop(ctx, query)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+
+	responseStruct := new(topResponse)
+	responseStruct.Status = STATS_STATUS_SUCCESS
+	responseStruct.By = topParams.by
+	responseStruct.Time = params.endTime.Unix()
+	responseStruct.Top = result.routes
+	if result.source != "" {
+		responseStruct.Prometheus = []string{result.source}
+	}
+	responseStruct.Warnings = result.warnings
+
+	jsonData, err := json.Marshal(responseStruct)
+	if err != nil {
+		return getErrorAsJSON(err)
+	}
+	return jsonData
+}
+
+// Build a Prometheus query that returns the n routes with the highest value of the specified statistic
+// The statistic is calculated over the window of the specified scope, and only metrics selected by that scope are considered
+func buildTopQuery(by string, quantile float64, n int, scope *queryScope) string {
+
+	var query string
+	switch by {
+	case topByCalls:
+		query = sumBy("rate("+scope.selector(promMetricNames[callsConst]).over(scope.window)+")", appLabel, routeLabel)
+	case topByErrorRatio:
+		numerator := sumBy("increase("+scope.selector(promMetricNames[errorsConst]).over(scope.window)+")", appLabel, routeLabel)
+		denominator := sumBy("increase("+scope.selector(promMetricNames[callsConst]).over(scope.window)+")", appLabel, routeLabel)
+		query = numerator + "/" + denominator
+	case topByTimeouts:
+		query = sumBy("increase("+scope.selector(promMetricNames[timedoutConst]).over(scope.window)+")", appLabel, routeLabel)
+	case topByDurations:
+		promMetricName := promMetricNames[durationsConst]
+		if quantile == 0 {
+			numerator := sumBy("rate("+scope.selector(promMetricName+"_sum").over(scope.window)+")", appLabel, routeLabel)
+			denominator := sumBy("rate("+scope.selector(promMetricName+"_count").over(scope.window)+")", appLabel, routeLabel)
+			query = numerator + "/" + denominator
+		} else {
+			buckets := sumBy("rate("+scope.selector(promMetricName+"_bucket").over(scope.window)+")", "le", appLabel, routeLabel)
+			query = "histogram_quantile(" + strconv.FormatFloat(quantile, 'f', -1, 64) + "," + buckets + ")"
+		}
+	}
+
+	// the comparison removes NaN values (such as the error ratio of a route with no calls) which would otherwise be ranked by topk
+	return "topk(" + strconv.Itoa(n) + ",(" + query + ")>=0)"
+}
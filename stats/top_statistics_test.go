@@ -0,0 +1,103 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// These tests check the top statistics API using a test server in place of Prometheus
+
+func TestBuildTopQuery(t *testing.T) {
+
+	scope := &queryScope{appName: "myapp", window: 5 * time.Minute}
+	tests := []struct {
+		by       string
+		quantile float64
+		expected string
+	}{
+		{topByCalls, 0, `topk(3,(sum(rate(fn_calls{fn_appname="myapp"}[300s]))by(fn_appname,fn_path))>=0)`},
+		{topByErrorRatio, 0, `topk(3,(sum(increase(fn_errors{fn_appname="myapp"}[300s]))by(fn_appname,fn_path)/sum(increase(fn_calls{fn_appname="myapp"}[300s]))by(fn_appname,fn_path))>=0)`},
+		{topByTimeouts, 0, `topk(3,(sum(increase(fn_timeouts{fn_appname="myapp"}[300s]))by(fn_appname,fn_path))>=0)`},
+		{topByDurations, 0, `topk(3,(sum(rate(fn_span_agent_submit_duration_seconds_sum{fn_appname="myapp"}[300s]))by(fn_appname,fn_path)/sum(rate(fn_span_agent_submit_duration_seconds_count{fn_appname="myapp"}[300s]))by(fn_appname,fn_path))>=0)`},
+		{topByDurations, 0.9, `topk(3,(histogram_quantile(0.9,sum(rate(fn_span_agent_submit_duration_seconds_bucket{fn_appname="myapp"}[300s]))by(le,fn_appname,fn_path)))>=0)`},
+	}
+	for _, test := range tests {
+		assertStringsEqual(t, "query for by="+test.by, test.expected, buildTopQuery(test.by, test.quantile, 3, scope))
+	}
+}
+
+func TestTopQueryParams(t *testing.T) {
+
+	tests := []struct {
+		query    string
+		expected topQueryParams
+	}{
+		{"", topQueryParams{by: topByCalls, n: defaultTopN}},
+		{"by=error_ratio&n=3", topQueryParams{by: topByErrorRatio, n: 3}},
+		{"by=durations&quantile=0.99", topQueryParams{by: topByDurations, n: defaultTopN, quantile: 0.99}},
+	}
+	for _, test := range tests {
+		params, err := getTopQueryParams(httptest.NewRequest("GET", "/v1/stats/top?"+test.query, nil))
+		assertNoError(t, "getting top query parameters from "+test.query, err)
+		if *params != test.expected {
+			t.Errorf("Expected %+v for %s, got %+v", test.expected, test.query, *params)
+		}
+	}
+
+	for _, query := range []string{"by=errors", "n=0", "n=few", "by=calls&quantile=0.5", "by=durations&quantile=0", "by=durations&quantile=1.5"} {
+		if _, err := getTopQueryParams(httptest.NewRequest("GET", "/v1/stats/top?"+query, nil)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestHandleTopWithPrometheus(t *testing.T) {
+
+	// Prometheus returns the routes in no particular order
+	var receivedQuery, receivedTime string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedQuery = r.URL.Query().Get("query")
+		receivedTime = r.URL.Query().Get("time")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[` +
+			`{"metric":{"fn_appname":"myapp","fn_path":"/a"},"value":[1500000300,"1"]},` +
+			`{"metric":{"fn_appname":"myapp","fn_path":"/b"},"value":[1500000300,"3"]}]}}`))
+	}))
+	defer server.Close()
+
+	savedConnection := promConnection
+	defer func() { promConnection = savedConnection }()
+	var err error
+	promConnection, err = newPrometheusConnection(&prometheusConnectionConfig{baseURLs: []string{server.URL}})
+	assertNoError(t, "creating connection", err)
+	savedBackend := statisticsBackend
+	defer func() { statisticsBackend = savedBackend }()
+	statisticsBackend = &prometheusBackend{}
+
+	r := httptest.NewRequest("GET", "/v1/apps/myapp/stats/top?by=calls&n=2&starttime=1500000000&endtime=1500000300", nil)
+	var response topResponse
+	assertNoError(t, "parsing response", json.Unmarshal(handleTop(r, "myapp"), &response))
+
+	assertStringsEqual(t, "status", STATS_STATUS_SUCCESS, response.Status)
+	// the statistic is calculated over the whole of the requested time period, ending at endtime
+	assertStringsEqual(t, "query", buildTopQuery(topByCalls, 0, 2, &queryScope{appName: "myapp", window: 5 * time.Minute}), receivedQuery)
+	assertStringsEqual(t, "time", time.Unix(1500000300, 0).Format(prometheusTimeFormat), receivedTime)
+	assertStringsEqual(t, "by", topByCalls, response.By)
+	assertIntsEqual(t, "time", 1500000300, int(response.Time))
+	assertIntsEqual(t, "Number of routes", 2, len(response.Top))
+	assertStringsEqual(t, "route with the most calls", "/b", response.Top[0].Route)
+	assertFloatsEqual(t, "calls to /b", 3, response.Top[0].Value)
+	assertStringsEqual(t, "route with the fewest calls", "/a", response.Top[1].Route)
+	if len(response.Prometheus) != 1 || response.Prometheus[0] != server.URL {
+		t.Errorf("Expected the response to be from %v, got %v", server.URL, response.Prometheus)
+	}
+
+	for _, query := range []string{"realtime=true", "starttime=1500000300&endtime=1500000300", "by=errors"} {
+		r := httptest.NewRequest("GET", "/v1/apps/myapp/stats/top?"+query, nil)
+		var response errorResponse
+		assertNoError(t, "parsing response", json.Unmarshal(handleTop(r, "myapp"), &response))
+		assertStringsEqual(t, "status for "+query, STATS_STATUS_ERROR, response.Status)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -35,6 +36,12 @@ func assertIntsEqual(t *testing.T, assertionText string, expected int, actual in
 	}
 }
 
+func assertFloatsEqual(t *testing.T, assertionText string, expected float64, actual float64) {
+	if math.Abs(actual-expected) > 1e-9 {
+		t.Fatal(assertionText + " FAILED: expected " + strconv.FormatFloat(expected, 'g', -1, 64) + ", actual " + strconv.FormatFloat(actual, 'g', -1, 64))
+	}
+}
+
 func checkIntsEqual(t *testing.T, assertionText string, expected int, actual int) error {
 	if actual != expected {
 		return errors.New(assertionText + " FAILED: expected " + strconv.Itoa(expected) + ", actual " + strconv.Itoa(actual))